@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// backend provides access to files in some location. Paths passed to a
+// backend do not include the scheme and host.
+type backend interface {
+	// ReadFile returns the contents of a file.
+	ReadFile(path string) ([]byte, error)
+
+	// WriteFile replaces the contents of a file, creating it if necessary.
+	WriteFile(path string, data []byte) error
+
+	// Stat returns whether a path is a directory, or an error if the path
+	// does not exist.
+	Stat(path string) (isDir bool, err error)
+
+	// ReadDir returns the names of entries in a directory. Names of
+	// directories have a trailing slash.
+	ReadDir(path string) ([]string, error)
+}
+
+// backends maps path schemes to functions that return a backend for a host.
+// Paths without a known scheme are local.
+var backends = map[string]func(host string) backend{
+	"ssh": func(host string) backend { return sshBackend(host) },
+}
+
+// splitPath returns the backend for path, the scheme and host part of the path
+// (or an empty string for local paths), and the rest of the path.
+func splitPath(path string) (b backend, prefix, rest string) {
+	if i := strings.Index(path, "://"); i > 0 {
+		if newBackend, ok := backends[path[:i]]; ok {
+			prefix, rest = path, "/"
+			if j := strings.Index(path[i+3:], "/"); j >= 0 {
+				prefix, rest = path[:i+3+j], path[i+3+j:]
+			}
+			// a leading /~/ makes the path relative to the home directory
+			if strings.HasPrefix(rest, "/~/") {
+				rest = rest[3:]
+			}
+			return newBackend(prefix[i+3:]), prefix, rest
+		}
+	}
+	return localBackend{}, "", path
+}
+
+// isRemote returns true if path is handled by a backend other than the local
+// file system.
+func isRemote(path string) bool {
+	_, prefix, _ := splitPath(path)
+	return prefix != ""
+}
+
+// readFile returns the contents of the file at path, using the appropriate
+// backend.
+func readFile(path string) ([]byte, error) {
+	b, _, rest := splitPath(path)
+	return b.ReadFile(rest)
+}
+
+// writeFile replaces the contents of the file at path, using the appropriate
+// backend.
+func writeFile(path string, data []byte) error {
+	b, _, rest := splitPath(path)
+	return b.WriteFile(rest, data)
+}
+
+// localBackend accesses the local file system.
+type localBackend struct{}
+
+func (localBackend) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (localBackend) WriteFile(path string, data []byte) error {
+	return ioutil.WriteFile(path, data, 0664)
+}
+
+func (localBackend) Stat(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+func (localBackend) ReadDir(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+		if fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 &&
+			isDir(filepath.Join(path, fi.Name())) {
+			names[i] += "/"
+		}
+	}
+	return names, nil
+}
+
+// sshBackend accesses files on a host by running shell commands there using
+// the transport command, which is invoked with the host name and command line
+// as its last two arguments.
+type sshBackend string
+
+// shellQuote quotes s for use as a single word in a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// run runs cmdLine on the host, with input as its standard input, and returns
+// its standard output.
+func (host sshBackend) run(cmdLine string, input []byte) ([]byte, error) {
+	args := strings.Fields(transportFlag)
+	if len(args) == 0 {
+		return nil, errors.New("No transport command.")
+	}
+	cmd := exec.Command(args[0], append(args[1:], string(host), cmdLine)...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", host, msg)
+		}
+	}
+	return output, err
+}
+
+func (host sshBackend) ReadFile(path string) ([]byte, error) {
+	return host.run("cat -- "+shellQuote(path), nil)
+}
+
+// WriteFile writes a temporary file next to the target and moves it into
+// place, as writeFileSafely does, so that a dropped connection cannot leave the
+// file partly written. Copying the target first keeps its mode.
+func (host sshBackend) WriteFile(path string, data []byte) error {
+	_, err := host.run(`f=`+shellQuote(path)+`
+if test -h "$f"; then f=$(readlink -f -- "$f") || exit; fi
+t=$(dirname -- "$f")/.$(basename -- "$f").$$
+cp -p -- "$f" "$t" 2>/dev/null
+cat > "$t" && mv -f -- "$t" "$f" || { rm -f -- "$t"; exit 1; }`, data)
+	return err
+}
+
+func (host sshBackend) Stat(path string) (bool, error) {
+	q := shellQuote(path)
+	output, err := host.run(fmt.Sprintf(
+		"if test -d %s; then echo d; elif test -e %s; then echo f; fi", q, q),
+		nil)
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(output)) {
+	case "d":
+		return true, nil
+	case "f":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %s: No such file or directory", host, path)
+}
+
+func (host sshBackend) ReadDir(path string) ([]string, error) {
+	if path == "" {
+		path = "." // home directory
+	}
+	output, err := host.run("ls -a1p -- "+shellQuote(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(output), "\n") {
+		if name != "" && name != "./" && name != "../" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestSSHBackend checks that reading, writing, stat and directory listing
+// work through the ssh backend, using a transport that runs commands locally.
+func TestSSHBackend(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the fake transport")
+	}
+	defer func(transport string) { transportFlag = transport }(transportFlag)
+	transportFlag = "sh testdata/fake-transport"
+
+	dir, err := ioutil.TempDir("", "fervor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "ssh://host" + filepath.ToSlash(dir)
+
+	// a quote in the name checks that paths are quoted for the shell
+	path := prefix + "/it's.txt"
+	if !isRemote(path) {
+		t.Fatalf("isRemote(%q) = false", path)
+	}
+	local := filepath.Join(dir, "it's.txt")
+	data := []byte("line 1\nline 2\n")
+	if err := writeFile(path, data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(got) != string(data) {
+		t.Errorf("readFile(%q) = %q, want %q", path, got, data)
+	}
+	if got, err := ioutil.ReadFile(local); err != nil {
+		t.Fatal(err)
+	} else if string(got) != string(data) {
+		t.Errorf("file contains %q, want %q", got, data)
+	}
+
+	// rewriting the file keeps its mode
+	if err := os.Chmod(local, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, data); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(local); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode after write = %v, want %v", fi.Mode().Perm(),
+			os.FileMode(0600))
+	}
+
+	b, _, rest := splitPath(path)
+	if isDir, err := b.Stat(rest); err != nil || isDir {
+		t.Errorf("Stat(%q) = %v, %v; want false, nil", rest, isDir, err)
+	}
+	b, _, rest = splitPath(prefix + "/sub")
+	if isDir, err := b.Stat(rest); err != nil || !isDir {
+		t.Errorf("Stat(%q) = %v, %v; want true, nil", rest, isDir, err)
+	}
+	b, _, rest = splitPath(prefix + "/missing")
+	if _, err := b.Stat(rest); err == nil {
+		t.Errorf("Stat(%q) succeeded for a missing file", rest)
+	}
+
+	b, _, rest = splitPath(prefix)
+	names, err := b.ReadDir(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{"it's.txt", "sub/"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir(%q) = %q, want %q", rest, names, want)
+	}
+
+	for _, c := range []struct{ path, want string }{
+		{prefix + "/it", path},
+		{prefix + "/s", prefix + "/sub/"},
+		{prefix + "/x", prefix + "/x"},
+	} {
+		if got := completePath(c.path, false); got != c.want {
+			t.Errorf("completePath(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jangler/edit"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// command is a named editor action that can be bound to a key sequence. The
+// shift argument to fn is true if the Shift key was held but was not part of
+// the binding, which makes cursor motions extend the selection. fn returns
+// false if the application should quit.
+type command struct {
+	desc string
+	fn   func(rc *RenderContext, shift bool) bool
+}
+
+// commands maps command names to commands. It is populated in init() to avoid
+// an initialization loop.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"buffer-end":   {"Move cursor to end of buffer", bufferEnd},
+		"buffer-start": {"Move cursor to beginning of buffer", bufferStart},
+		"build":        {"Run build command for filetype", build},
+		"cancel":       {"Cancel (in prompt)", cancel},
+		"cd":           {"Change directory...", changeDir},
+		"copy":         {"Copy (in buffer), cancel (in prompt)", copySel},
+		"cut":          {"Cut", cut},
+		"delete-backward": {"Delete character backward",
+			deleteBackward},
+		"delete-forward": {"Delete character forward", deleteForward},
+		"delete-line-backward": {"Delete line backward",
+			deleteLineBackward},
+		"delete-word-backward": {"Delete word backward",
+			deleteWordBackward},
+		"delete-word-forward": {"Delete word forward", deleteWordForward},
+		"down": {"Move cursor down, next history entry (in prompt)",
+			down},
+		"enter": {"Insert newline (in buffer), enter input (in prompt)",
+			enter},
+		"find-backward": {"Find regexp backward...", findBackward},
+		"find-forward":  {"Find regexp forward...", findForward},
+		"go-to-line":    {"Go to line...", goToLine},
+		"grep":          {"Grep files under working directory...", grep},
+		"help":          {"Show help (or return from help)", help},
+		"ignorecase": {"Toggle case-insensitive search",
+			toggleSearchOption("ignorecase")},
+		"indent": {"Indent selection, complete word (searching backward)",
+			indentSel},
+		"inselection": {"Toggle searching only in selection",
+			toggleSearchOption("inselection")},
+		"insert-tab":   {"Insert tab", insertTab},
+		"jobs":         {"List running commands...", listJobs},
+		"kill":         {"Kill command piping into buffer", killCmd},
+		"left":         {"Move cursor left", left},
+		"line-end":     {"Move cursor to end of line", lineEnd},
+		"line-endings": {"Toggle Unix/DOS line endings", toggleLineEndings},
+		"line-start":   {"Move cursor to beginning of line", lineStart},
+		"literal": {"Toggle literal (non-regexp) search",
+			toggleSearchOption("literal")},
+		"next-buffer": {"Switch to next buffer", nextBuffer},
+		"next-error":  {"Go to next error in command output", nextError},
+		"next-match":  {"Next match", nextMatch},
+		"open":        {"Open...", open},
+		"open-new":    {"Open in new window...", openNew},
+		"page-down":   {"Move cursor down one page", pageDown},
+		"page-up":     {"Move cursor up one page", pageUp},
+		"paste":       {"Paste", paste},
+		"pipe":        {"Pipe selection through command...", pipe},
+		"play-macro":  {"Play macro...", playMacro},
+		"prev-error": {"Go to previous error in command output",
+			prevError},
+		"prev-match":   {"Previous match", prevMatch},
+		"quit":         {"Quit (or close scratch buffer)", quit},
+		"quit-force":   {"Quit without confirmation", quitForce},
+		"record-macro": {"Record macro... (or stop recording)", recordMacro},
+		"redo":         {"Redo", redo},
+		"reload-font":  {"Reload font (fixes missing glyphs)", reloadFont},
+		"repeat":       {"Repeat last edit", repeatEdit},
+		"replace":      {"Replace regexp...", replace},
+		"replace-files": {"Replace regexp in files under working directory...",
+			replaceFiles},
+		"revert-replace": {"Revert last replacement in files",
+			revertReplace},
+		"right":    {"Move cursor right", right},
+		"run":      {"Run command..., search history (in prompt)", run},
+		"save":     {"Save", save},
+		"save-as":  {"Save as...", saveAs},
+		"set":      {"Set option...", setOption},
+		"terminal": {"Open terminal running command...", openTerminal},
+		"undo":     {"Undo", undo},
+		"unindent": {"Unindent selection, complete word (searching forward)",
+			unindentSel},
+		"up": {"Move cursor up, previous history entry (in prompt)",
+			up},
+		"wholeword": {"Toggle whole-word search",
+			toggleSearchOption("wholeword")},
+		"word-left":  {"Move cursor left one word", wordLeft},
+		"word-right": {"Move cursor right one word", wordRight},
+		"wrapsearch": {"Toggle wrap-around search",
+			toggleSearchOption("wrapsearch")},
+	}
+}
+
+// moveCursor moves the insertion mark of the focused buffer to index. The
+// selection anchor follows unless shift is true.
+func (rc *RenderContext) moveCursor(index edit.Index, shift bool) {
+	rc.Focus.Mark(index, insMark)
+	if !shift {
+		rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
+	}
+	if rc.Focus == rc.Pane.Buffer {
+		rc.Pane.Separate()
+	}
+}
+
+// setInput replaces the contents of the input buffer with s.
+func (rc *RenderContext) setInput(s string) {
+	rc.Input.Delete(edit.Index{1, 0}, rc.Input.End())
+	rc.Input.Insert(edit.Index{1, 0}, s)
+}
+
+// cancelPrompt exits prompt mode without taking action.
+func (rc *RenderContext) cancelPrompt() {
+	rc.endSearch(true)
+	rc.endHistorySearch(false)
+	rc.Status = rc.Pane.Title
+	rc.Focus = rc.Pane.Buffer
+	if rc.Replace != nil && rc.Replace.pane != nil {
+		rc.finishReplace(rc.Replace.count)
+	}
+	rc.Replace = nil
+}
+
+func bufferEnd(rc *RenderContext, shift bool) bool {
+	rc.moveCursor(rc.Focus.End(), shift)
+	return true
+}
+
+func bufferStart(rc *RenderContext, shift bool) bool {
+	rc.moveCursor(edit.Index{1, 0}, shift)
+	return true
+}
+
+func cancel(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	}
+	return true
+}
+
+func changeDir(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(cdPrompt)
+	}
+	return true
+}
+
+func copySel(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	} else {
+		sdl.SetClipboardText(getSelection(rc.Pane.Buffer))
+		rc.Status = "Copied text."
+	}
+	return true
+}
+
+func cut(rc *RenderContext, shift bool) bool {
+	sel := rc.Focus.IndexFromMark(selMark)
+	insert := rc.Focus.IndexFromMark(insMark)
+	sdl.SetClipboardText(rc.Focus.Get(order(sel, insert)))
+	rc.Focus.Delete(order(sel, insert))
+	return true
+}
+
+func deleteBackward(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer && rc.Pane.Kind == previewPane {
+		rc.dropHunk(rc.Pane.IndexFromMark(insMark).Line)
+		return true
+	}
+	index := rc.Focus.IndexFromMark(insMark)
+	if sel := rc.Focus.IndexFromMark(selMark); sel != index {
+		rc.Focus.Delete(order(sel, index))
+	} else {
+		deleteCharOrTab(rc.Focus, index, -1)
+	}
+	return true
+}
+
+func deleteForward(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer && rc.Pane.Kind == previewPane {
+		rc.dropHunk(rc.Pane.IndexFromMark(insMark).Line)
+		return true
+	}
+	index := rc.Focus.IndexFromMark(insMark)
+	if sel := rc.Focus.IndexFromMark(selMark); sel != index {
+		rc.Focus.Delete(order(sel, index))
+	} else {
+		deleteCharOrTab(rc.Focus, index, 1)
+	}
+	if rc.Focus == rc.Pane.Buffer {
+		seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+	}
+	return true
+}
+
+func deleteLineBackward(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.Focus.Delete(edit.Index{index.Line, 0}, index)
+	return true
+}
+
+func deleteWordBackward(rc *RenderContext, shift bool) bool {
+	end := rc.Focus.IndexFromMark(insMark)
+	begin := shiftIndexByWord(rc.Focus, end, -1)
+	rc.Focus.Delete(begin, end)
+	return true
+}
+
+func deleteWordForward(rc *RenderContext, shift bool) bool {
+	begin := rc.Focus.IndexFromMark(insMark)
+	end := shiftIndexByWord(rc.Focus, begin, 1)
+	rc.Focus.Delete(begin, end)
+	return true
+}
+
+func down(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer {
+		col, row := rc.Focus.CoordsFromIndex(rc.Focus.IndexFromMark(insMark))
+		rc.moveCursor(rc.Focus.IndexFromCoords(col, row+1), shift)
+	} else {
+		rc.setInput(getHistory(rc.Histories, rc.Status).next())
+	}
+	return true
+}
+
+func enter(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer && rc.Pane.Term != nil {
+		if err := rc.Pane.termSend(); err != nil {
+			rc.Status = err.Error()
+		}
+		return true
+	} else if rc.Focus == rc.Pane.Buffer && rc.Pane.Kind == grepPane {
+		rc.openGrepHit(rc.Pane.IndexFromMark(insMark).Line)
+		return true
+	} else if rc.Focus == rc.Pane.Buffer {
+		textInput(rc.Focus, "\n")
+		return true
+	}
+	rc.endHistorySearch(true)
+	input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
+	command := rc.Status == runPrompt || rc.Status == pipePrompt ||
+		rc.Status == terminalPrompt
+	if !command || !strings.HasPrefix(input, " ") { // as in shells
+		getHistory(rc.Histories, rc.Status).add(input)
+	}
+	return rc.EnterInput()
+}
+
+func findBackward(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.startSearch(findBackwardPrompt)
+	}
+	return true
+}
+
+func findForward(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.startSearch(findForwardPrompt)
+	}
+	return true
+}
+
+func goToLine(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(goToLinePrompt)
+	}
+	return true
+}
+
+// tabOrComplete inserts a tab if the cursor follows whitespace, and otherwise
+// completes the word before the cursor.
+func tabOrComplete(rc *RenderContext, forward bool) {
+	ins := rc.Pane.IndexFromMark(insMark)
+	char := rc.Pane.Get(edit.Index{ins.Line, ins.Char - 1}, ins)
+	if char == "" || char == " " || char == "\t" {
+		// insert tab
+		if expandtabFlag {
+			for i := 0; i < int(tabstopFlag); i++ {
+				textInput(rc.Focus, " ")
+			}
+		} else {
+			textInput(rc.Focus, "\t")
+		}
+	} else {
+		// complete word
+		selectWord(rc.Focus, ins)
+		word := getSelection(rc.Focus)
+		completion := completeWord(rc.Focus, word, forward)
+		if completion != "" {
+			textInput(rc.Focus, completion)
+		} else {
+			rc.Status = "No completions."
+		}
+		rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
+	}
+}
+
+// completeInput completes the text in the input buffer based on the prompt.
+func (rc *RenderContext) completeInput() {
+	input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
+	input = expandVars(input)
+	switch rc.Status {
+	case cdPrompt:
+		input = completePath(input, true)
+	case openPrompt, openNewPrompt, saveAsPrompt:
+		input = completePath(input, false)
+	case setPrompt:
+		input = completeOption(input)
+	case pipePrompt, runPrompt, terminalPrompt:
+		tokens := strings.Split(input, " ")
+		for i, token := range tokens {
+			if i == 0 {
+				tokens[i] = completeCmd(token)
+			} else {
+				tokens[i] = completePath(token, false)
+			}
+		}
+		input = strings.Join(tokens, " ")
+	}
+	rc.setInput(input)
+}
+
+func indentSel(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Pane.Buffer {
+		rc.completeInput()
+	} else if sel, ins := order(rc.Pane.IndexFromMark(selMark),
+		rc.Pane.IndexFromMark(insMark)); sel != ins {
+		indent(rc.Pane.Buffer, sel.Line, ins.Line, false)
+	} else {
+		tabOrComplete(rc, false)
+	}
+	return true
+}
+
+func insertTab(rc *RenderContext, shift bool) bool {
+	textInput(rc.Focus, "\t")
+	return true
+}
+
+func left(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(rc.Focus.ShiftIndex(index, -1), shift)
+	return true
+}
+
+func lineEnd(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(edit.Index{index.Line, 1 << 30}, shift)
+	return true
+}
+
+func toggleLineEndings(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		if rc.Pane.LineEnding == "\n" {
+			rc.Pane.LineEnding = "\r\n"
+			rc.Status = "Using DOS line endings."
+		} else {
+			rc.Pane.LineEnding = "\n"
+			rc.Status = "Using Unix line endings."
+		}
+	}
+	return true
+}
+
+func lineStart(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(edit.Index{index.Line, 0}, shift)
+	return true
+}
+
+func nextBuffer(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	for i, p := range rc.Panes {
+		if p == rc.Pane {
+			rc.showPane(rc.Panes[(i+1)%len(rc.Panes)])
+			break
+		}
+	}
+	return true
+}
+
+func nextMatch(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.findMatch(true)
+	}
+	return true
+}
+
+func open(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		if rc.Pane.Modified() && !isStdinPane(rc.Pane) {
+			rc.Prompt(reallyOpenPrompt)
+		} else {
+			rc.Prompt(openPrompt)
+		}
+	}
+	return true
+}
+
+func openNew(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(openNewPrompt)
+	}
+	return true
+}
+
+func pageDown(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer {
+		col, row := rc.Pane.CoordsFromIndex(rc.Pane.IndexFromMark(insMark))
+		rc.moveCursor(rc.Pane.IndexFromCoords(col, row+rc.Pane.Rows), shift)
+	}
+	return true
+}
+
+func pageUp(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer {
+		col, row := rc.Pane.CoordsFromIndex(rc.Pane.IndexFromMark(insMark))
+		rc.moveCursor(rc.Pane.IndexFromCoords(col, row-rc.Pane.Rows), shift)
+	}
+	return true
+}
+
+func paste(rc *RenderContext, shift bool) bool {
+	text, err := sdl.GetClipboardText()
+	if err != nil {
+		rc.Status = err.Error()
+		return true
+	}
+	sel := rc.Focus.IndexFromMark(selMark)
+	insert := rc.Focus.IndexFromMark(insMark)
+	if sel != insert {
+		rc.Focus.Delete(order(sel, insert))
+		insert, _ = order(sel, insert)
+	}
+	rc.Focus.Insert(insert, text)
+	return true
+}
+
+func pipe(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(pipePrompt)
+	}
+	return true
+}
+
+func prevMatch(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.findMatch(false)
+	}
+	return true
+}
+
+func quit(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Pane.Buffer {
+		rc.cancelPrompt()
+	} else if rc.Pane.Scratch {
+		rc.closePane()
+	} else if rc.modified() {
+		rc.Prompt(reallyQuitPrompt)
+	} else if rc.runningJobs() {
+		rc.Prompt(reallyQuitJobsPrompt)
+	} else {
+		return false
+	}
+	return true
+}
+
+func quitForce(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Pane.Buffer {
+		rc.cancelPrompt()
+		return true
+	}
+	rc.Cancelled = true
+	return false
+}
+
+func redo(rc *RenderContext, shift bool) bool {
+	if !rc.Pane.Redo(selMark, insMark) {
+		rc.Status = "Nothing to redo."
+	} else if rc.Pane.Regions != nil {
+		rc.Pane.Regions.reset(rc.Pane.Buffer) // the edits may be anywhere
+	}
+	return true
+}
+
+func reloadFont(rc *RenderContext, shift bool) bool {
+	rc.Font = getFont()
+	rc.Status = "Reloaded font."
+	return true
+}
+
+func right(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(rc.Focus.ShiftIndex(index, 1), shift)
+	return true
+}
+
+func run(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(runPrompt)
+	} else {
+		rc.searchHistory()
+	}
+	return true
+}
+
+func save(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	if rc.Pane.Kind == previewPane {
+		rc.applyPreview()
+		return true
+	}
+	if err := saveFile(rc.Pane); err == nil {
+		rc.Status = fmt.Sprintf(`Saved "%s".`, rc.Pane.Title)
+		if rc.Pane.LineEnding == "\r\n" {
+			rc.Status += " [DOS]"
+		}
+	} else {
+		rc.Status = err.Error()
+	}
+	return true
+}
+
+func saveAs(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(saveAsPrompt)
+	}
+	return true
+}
+
+func setOption(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(setPrompt)
+	}
+	return true
+}
+
+func undo(rc *RenderContext, shift bool) bool {
+	if !rc.Pane.Undo(selMark, insMark) {
+		rc.Status = "Nothing to undo."
+	} else if rc.Pane.Regions != nil {
+		rc.Pane.Regions.reset(rc.Pane.Buffer) // the edits may be anywhere
+	}
+	return true
+}
+
+func unindentSel(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Pane.Buffer {
+		rc.completeInput()
+	} else if sel, ins := order(rc.Pane.IndexFromMark(selMark),
+		rc.Pane.IndexFromMark(insMark)); sel != ins {
+		indent(rc.Pane.Buffer, sel.Line, ins.Line, true)
+	} else {
+		tabOrComplete(rc, true)
+	}
+	return true
+}
+
+func up(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer {
+		col, row := rc.Focus.CoordsFromIndex(rc.Focus.IndexFromMark(insMark))
+		rc.moveCursor(rc.Focus.IndexFromCoords(col, row-1), shift)
+	} else {
+		input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
+		rc.setInput(getHistory(rc.Histories, rc.Status).prev(input))
+	}
+	return true
+}
+
+func wordLeft(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(shiftIndexByWord(rc.Focus, index, -1), shift)
+	return true
+}
+
+func wordRight(rc *RenderContext, shift bool) bool {
+	index := rc.Focus.IndexFromMark(insMark)
+	rc.moveCursor(shiftIndexByWord(rc.Focus, index, 1), shift)
+	return true
+}
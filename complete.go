@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/user"
+	pathpkg "path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -58,51 +61,134 @@ func completeCmd(cmd string) string {
 	return prefix
 }
 
+// completeOption completes the typed option name to the longest common prefix
+// of options that can be set at runtime, or completes the value of a boolean
+// or path option.
+func completeOption(input string) string {
+	tokens := strings.SplitN(input, "=", 2)
+	if len(tokens) == 2 {
+		name, value := tokens[0], tokens[1]
+		f := flag.Lookup(name)
+		if f == nil {
+			return input
+		}
+		if b, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && b.IsBoolFlag() {
+			if value == "" {
+				// offer to toggle the current value
+				value = fmt.Sprintf("%v", f.Value.String() != "true")
+			} else if strings.HasPrefix("true", value) {
+				value = "true"
+			} else if strings.HasPrefix("false", value) {
+				value = "false"
+			}
+		} else if name == "font" {
+			value = completePath(value, false)
+		} else if name == "theme" {
+			var prefix string
+			for _, theme := range themeNames() {
+				if strings.HasPrefix(theme, value) {
+					if prefix == "" {
+						prefix = theme
+					} else {
+						prefix = commonPrefix(prefix, theme)
+					}
+				}
+			}
+			if prefix != "" {
+				value = prefix
+			}
+		} else if value == "" {
+			value = f.Value.String()
+		}
+		return name + "=" + value
+	}
+
+	var prefix string
+	matches := 0
+	flag.VisitAll(func(f *flag.Flag) {
+		if !cmdLineFlags[f.Name] && strings.HasPrefix(f.Name, input) {
+			if matches == 0 {
+				prefix = f.Name
+			} else {
+				prefix = commonPrefix(prefix, f.Name)
+			}
+			matches++
+		}
+	})
+	if matches == 1 {
+		return prefix + "="
+	} else if matches > 1 {
+		return prefix
+	}
+	return input
+}
+
 // completePath completes the typed path to the longest common prefix of paths
-// in the directory.
+// in the directory. Remote paths are completed using their backend.
 func completePath(path string, dirsOnly bool) string {
-	// read filenames from dir
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return path
-	}
+	b, prefix, rest := splitPath(path)
 	var dir, file string
-	if strings.HasSuffix(path, "/") {
-		dir = absPath
+	if prefix == "" {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return path
+		}
+		if strings.HasSuffix(path, "/") {
+			dir = absPath
+		} else {
+			dir, file = filepath.Split(absPath)
+		}
+	} else if strings.HasSuffix(rest, "/") || rest == "" {
+		dir = rest
 	} else {
-		dir, file = filepath.Split(absPath)
+		dir, file = pathpkg.Split(rest)
 	}
-	f, err := os.Open(dir)
-	if err != nil {
-		return path
-	}
-	names, err := f.Readdirnames(0)
-	f.Close()
+
+	// read filenames from dir
+	names, err := b.ReadDir(dir)
 	if err != nil {
 		return path
 	}
 
 	// return a match if there is exactly one
-	var prefix string
+	var match string
 	for _, name := range names {
 		if strings.HasPrefix(name, file) &&
-			(!dirsOnly || isDir(filepath.Join(dir, name))) {
-			if prefix == "" {
-				prefix = name
+			(!dirsOnly || strings.HasSuffix(name, "/")) {
+			if match == "" {
+				match = name
 			} else {
-				if prefix = commonPrefix(prefix, name); prefix == "" {
+				if match = commonPrefix(match, name); match == "" {
 					break
 				}
 			}
 		}
 	}
-	if prefix != "" {
-		path = filepath.Join(dir, prefix)
+	match = strings.TrimSuffix(match, "/")
+	if prefix == "" {
+		if match != "" {
+			path = filepath.Join(dir, match)
+		}
+		if isDir, err := b.Stat(path); err == nil && isDir {
+			return minPath(path) + "/"
+		}
+		return minPath(path)
+	}
+	if match != "" {
+		rest = dir + match
+		if strings.HasPrefix(rest, "/") {
+			path = prefix + rest
+		} else {
+			path = prefix + "/~/" + rest
+		}
 	}
-	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
-		return minPath(path) + "/"
+	if isDir, err := b.Stat(rest); err == nil && isDir &&
+		!strings.HasSuffix(path, "/") {
+		return path + "/"
 	}
-	return minPath(path)
+	return path
 }
 
 // completeWord completes the typed word to the first match in the buffer.
@@ -148,10 +234,10 @@ func completeWord(b *edit.Buffer, prefix string, forward bool) string {
 }
 
 // expandVars returns a version of path with environment variables and ~/
-// expanded.
+// expanded. ~/ is not expanded in remote paths.
 func expandVars(path string) string {
 	path = os.ExpandEnv(path)
-	if curUser, err := user.Current(); err == nil {
+	if curUser, err := user.Current(); err == nil && !isRemote(path) {
 		path = strings.Replace(path, "~/", curUser.HomeDir+"/", -1)
 	}
 	return path
@@ -166,7 +252,12 @@ func isDir(path string) bool {
 }
 
 // minPath returns the shortest valid representation of the given file path.
+// Remote paths are returned unchanged.
 func minPath(path string) string {
+	if isRemote(path) {
+		return path
+	}
+
 	// try absolute path
 	abs, err := filepath.Abs(path)
 	if err != nil {
@@ -194,3 +285,16 @@ func minPath(path string) string {
 
 	return filepath.Clean(path)
 }
+
+// absPath returns the absolute form of the given file path, expanding
+// variables and ~. Remote paths are returned unchanged.
+func absPath(path string) string {
+	path = expandVars(path)
+	if isRemote(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
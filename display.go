@@ -1,6 +1,7 @@
 package main
 
 import (
+	"container/list"
 	"fmt"
 	"log"
 	"os"
@@ -15,45 +16,13 @@ import (
 
 const padPx = 2 // number of pixels used to pad UI elements
 
+var fontHeight, fontWidth int
+
 var (
-	lightBgColor      = sdl.Color{0xff, 0xff, 0xff, 0xff}
-	lightFgColor      = sdl.Color{0x2f, 0x2f, 0x2f, 0xff}
-	lightStatusColor  = sdl.Color{0xe8, 0xe8, 0xe8, 0xff}
-	lightCommentColor = sdl.Color{0x3f, 0x5a, 0x8d, 0xff}
-	lightKeywordColor = sdl.Color{0x3a, 0x63, 0x41, 0xff}
-	lightLiteralColor = sdl.Color{0x8e, 0x4a, 0x43, 0xff}
-
-	darkBgColor      = sdl.Color{0x25, 0x25, 0x25, 0xff}
-	darkFgColor      = sdl.Color{0xe2, 0xe2, 0xe2, 0xff}
-	darkStatusColor  = sdl.Color{0x40, 0x40, 0x40, 0xff}
-	darkCommentColor = sdl.Color{0xa0, 0xb6, 0xdf, 0xff}
-	darkKeywordColor = sdl.Color{0x99, 0xbe, 0x9f, 0xff}
-	darkLiteralColor = sdl.Color{0xda, 0xaa, 0xa5, 0xff}
-
-	bgColor, fgColor, statusColor            sdl.Color
-	commentColor, keywordColor, literalColor sdl.Color
+	loadedFont   string // font flag value the font was last loaded with
+	loadedPtsize int    // ptsize flag value the font was last loaded with
 )
 
-func setColorScheme() {
-	if darkFlag {
-		bgColor = darkBgColor
-		fgColor = darkFgColor
-		statusColor = darkStatusColor
-		commentColor = darkCommentColor
-		keywordColor = darkKeywordColor
-		literalColor = darkLiteralColor
-	} else {
-		bgColor = lightBgColor
-		fgColor = lightFgColor
-		statusColor = lightStatusColor
-		commentColor = lightCommentColor
-		keywordColor = lightKeywordColor
-		literalColor = lightLiteralColor
-	}
-}
-
-var fontHeight, fontWidth int
-
 // Pane is a buffer with associated metadata.
 type Pane struct {
 	*edit.Buffer
@@ -61,12 +30,30 @@ type Pane struct {
 	TabWidth   int
 	Cols, Rows int
 	LineEnding string
+	Group      int       // if nonzero, edits are grouped into one undo action
+	ReadOnly   bool      // whether the buffer can be edited
+	Scratch    bool      // whether the buffer is not associated with a file
+	Term       *terminal // process attached to the pane, if any
+	Pipe       *pipeJob  // command piping output into the pane, if any
+	Kind       paneKind  // for panes in which some commands act differently
+	ID         int       // identifies the pane to commands it runs, if set
+
+	Regions *highlighter // multi-line syntax state, if any
+}
+
+// Separate inserts an undo separator into the pane's buffer, unless edits are
+// being grouped or a command is piping output into the pane.
+func (p *Pane) Separate() {
+	if p.Group == 0 && p.Pipe == nil {
+		p.Buffer.Separate()
+	}
 }
 
 // getFont loads the default TTF from memory and returns it.
 func getFont() *ttf.Font {
 	var font *ttf.Font
 	var err error
+	loadedFont, loadedPtsize = fontFlag, ptsizeFlag
 	// if font flag is specified, try loading that font
 	if fontFlag != "" {
 		font, err = ttf.OpenFont(fontFlag, ptsizeFlag)
@@ -126,77 +113,141 @@ func createWindow(title string, font *ttf.Font) *sdl.Window {
 	return win
 }
 
-// drawBuffer draws the displayed contents of b to dst using font.
-func drawBuffer(b *edit.Buffer, font *ttf.Font, dst *sdl.Surface,
-	focused bool) {
+// tagColor returns the color used for text with a syntax rule ID.
+func tagColor(id int) sdl.Color {
+	switch id {
+	case commentID:
+		return commentColor
+	case keywordID:
+		return keywordColor
+	case literalID:
+		return literalColor
+	}
+	return fgColor
+}
+
+// piece is a run of text drawn in one color.
+type piece struct {
+	text []rune
+	fg   sdl.Color
+}
+
+// colorPieces splits the fragments of a display line into pieces of colored
+// text. Spans of columns in multi-line regions override fragment tags.
+func colorPieces(line *list.List, spans []span) []piece {
+	var pieces []piece
+	c := 0
+	for e := line.Front(); e != nil; e = e.Next() {
+		frag := e.Value.(edit.Fragment)
+		runes := []rune(frag.Text)
+		for len(runes) > 0 {
+			n, fg := len(runes), tagColor(frag.Tag)
+			for _, s := range spans {
+				if c >= s.start && c < s.end {
+					if s.end-c < n {
+						n = s.end - c
+					}
+					fg = tagColor(s.id)
+					break
+				} else if s.start > c && s.start-c < n {
+					n = s.start - c
+				}
+			}
+			pieces = append(pieces, piece{runes[:n], fg})
+			runes, c = runes[n:], c+n
+		}
+	}
+	return pieces
+}
+
+// shade is a range of columns in a display row drawn with a background color.
+type shade struct {
+	start, end int
+	bg         sdl.Color
+}
+
+// addShades adds shades covering the text from start to end to the rows of
+// shades that are displayed.
+func addShades(shades [][]shade, b *edit.Buffer, start, end edit.Index,
+	bg sdl.Color) {
+	startCol, startRow := b.CoordsFromIndex(start)
+	endCol, endRow := b.CoordsFromIndex(end)
+	for row := startRow; row <= endRow && row < len(shades); row++ {
+		if row >= 0 {
+			s := shade{0, 1 << 30, bg}
+			if row == startRow {
+				s.start = startCol
+			}
+			if row == endRow {
+				s.end = endCol
+			}
+			shades[row] = append(shades[row], s)
+		}
+	}
+}
+
+// drawBuffer draws the displayed contents of p to dst using font. Visible
+// matches of res are highlighted.
+func drawBuffer(p *Pane, font *ttf.Font, dst *sdl.Surface, focused bool,
+	res []*regexp.Regexp) {
+	b := p.Buffer
 	x, y := padPx, padPx
 
 	// get cursor position
 	ins := b.IndexFromMark(insMark)
 	col, row := b.CoordsFromIndex(ins)
 
-	// get selection start and end positions
-	sel := b.IndexFromMark(selMark)
-	selStart, selEnd := order(sel, ins)
-	startCol, startRow := b.CoordsFromIndex(selStart)
-	endCol, endRow := b.CoordsFromIndex(selEnd)
+	// bring multi-line syntax state up to date through the last visible line
+	if p.Regions != nil {
+		p.Regions.sync(b)
+		p.Regions.update(b, b.IndexFromCoords(0, p.Rows).Line)
+	}
+
+	// shade matches, then the selection over them
+	lines := b.DisplayLines()
+	shades := make([][]shade, len(lines))
+	for _, m := range visibleMatches(p, res) {
+		addShades(shades, b, m[0], m[1], matchColor)
+	}
+	if sel := b.IndexFromMark(selMark); sel != ins {
+		selStart, selEnd := order(sel, ins)
+		addShades(shades, b, selStart, selEnd, selectionColor)
+	}
 
 	// draw each line in display
-	for i, line := range b.DisplayLines() {
+	for i, line := range lines {
+		var spans []span
+		if p.Regions != nil {
+			spans = p.Regions.lineSpans(b, b.IndexFromCoords(0, i).Line)
+		}
 		c := 0
 
-		// draw each syntax-highlighted fragment
-		for e := line.Front(); e != nil; e = e.Next() {
-			text := e.Value.(edit.Fragment).Text
-			fg := fgColor
-			switch e.Value.(edit.Fragment).Tag {
-			case commentID:
-				fg = commentColor
-			case keywordID:
-				fg = keywordColor
-			case literalID:
-				fg = literalColor
-			}
-
-			if sel != ins && i >= startRow && i <= endRow {
-				// text might be in selection range, so it needs to be split
-				// and drawn piecewise
-				pre, mid, post := []rune(""), []rune(""), []rune("")
-				runes := []rune(text)
-				if i == startRow && c < startCol {
-					if startCol-c < len(runes) {
-						pre = runes[:startCol-c]
-					} else {
-						pre = runes
+		// draw each syntax-highlighted piece, split where shading changes
+		for _, pc := range colorPieces(line, spans) {
+			runes, fg := pc.text, pc.fg
+			for len(runes) > 0 {
+				n, bg := len(runes), bgColor
+				for _, s := range shades[i] {
+					if c >= s.start && c < s.end {
+						bg = s.bg
 					}
-				}
-				if i == endRow && c+len(runes) > endCol {
-					if c < endCol {
-						post = runes[endCol-c:]
-					} else {
-						post = runes
+					for _, edge := range []int{s.start, s.end} {
+						if edge > c && edge-c < n {
+							n = edge - c
+						}
 					}
 				}
-				mid = runes[len(pre) : len(runes)-len(post)]
-
-				drawString(font, string(pre), fg, bgColor, dst, x, y)
-				x += len(pre) * fontWidth
-				drawString(font, string(mid), fg, statusColor, dst, x, y)
-				x += len(mid) * fontWidth
-				drawString(font, string(post), fg, bgColor, dst, x, y)
-				x += len(post) * fontWidth
-
-				c += len(runes)
-			} else {
-				drawString(font, text, fg, bgColor, dst, x, y)
-				x += utf8.RuneCountInString(text) * fontWidth
+				drawString(font, string(runes[:n]), fg, bg, dst, x, y)
+				x += n * fontWidth
+				runes, c = runes[n:], c+n
 			}
 		}
 
 		if focused && i == row {
 			// draw cursor
 			dst.FillRect(&sdl.Rect{int32(padPx + fontWidth*col), int32(y),
-				1 + int32(ptsizeFlag)/18, int32(fontHeight)}, fgColor.Uint32())
+				1 + int32(ptsizeFlag)/18, int32(fontHeight)},
+				cursorColor.Uint32())
 		}
 
 		y += fontHeight
@@ -229,8 +280,9 @@ func drawString(font *ttf.Font, s string, fg, bg sdl.Color, dst *sdl.Surface,
 	}
 }
 
-// drawStatusLine draws s at the bottom of dst using font.
-func drawStatusLine(dst *sdl.Surface, font *ttf.Font, s string,
+// drawStatusLine draws s at the bottom of dst using font. If the prompt is
+// focused, note is drawn after the input.
+func drawStatusLine(dst *sdl.Surface, font *ttf.Font, s, note string,
 	input *edit.Buffer, pane *Pane, focused bool) {
 	// draw background
 	bgRect := sdl.Rect{
@@ -247,13 +299,23 @@ func drawStatusLine(dst *sdl.Surface, font *ttf.Font, s string,
 	x += utf8.RuneCountInString(s) * fontWidth
 
 	if focused {
-		// draw input text and cursor
-		drawString(font, input.Get(edit.Index{1, 0}, input.End()), fgColor,
-			statusColor, dst, x, y)
+		// draw input text, note, and cursor
+		text := input.Get(edit.Index{1, 0}, input.End())
+		drawString(font, text, fgColor, statusColor, dst, x, y)
+		if note != "" {
+			drawString(font, fmt.Sprintf(" [%s]", note), fgColor, statusColor,
+				dst, x+utf8.RuneCountInString(text)*fontWidth, y)
+		}
 		index := input.IndexFromMark(insMark)
 		dst.FillRect(&sdl.Rect{int32(x + fontWidth*index.Char), int32(y),
-			1 + int32(ptsizeFlag)/18, int32(fontHeight)}, fgColor.Uint32())
+			1 + int32(ptsizeFlag)/18, int32(fontHeight)}, cursorColor.Uint32())
 	} else if s == pane.Title {
+		if pane.Pipe != nil {
+			// draw running command
+			drawString(font, fmt.Sprintf(` [running "%s"]`,
+				pane.Pipe.cmdString), fgColor, statusColor, dst, x, y)
+		}
+
 		// draw cursor pos
 		index := pane.IndexFromMark(insMark)
 		line := pane.Get(edit.Index{index.Line, 0}, index)
@@ -297,13 +359,49 @@ func bufSize(width, height int) (cols, rows int) {
 
 // RenderContext contains information needed to update the display.
 type RenderContext struct {
-	Pane   *Pane
-	Input  *edit.Buffer
-	Focus  *edit.Buffer
-	Status string
-	Font   *ttf.Font
-	Window *sdl.Window
-	Regexp *regexp.Regexp
+	Pane         *Pane
+	Panes        []*Pane // all open panes, in order of opening
+	Input        *edit.Buffer
+	Focus        *edit.Buffer
+	Status       string
+	Font         *ttf.Font
+	Window       *sdl.Window
+	Pattern      string              // last pattern searched for
+	Histories    map[string]*history // prompt histories, keyed by prompt
+	Jobs         []*job              // running and recently finished jobs
+	JobCount     int                 // number of jobs started
+	ErrorLine    int                 // output line of last error visited
+	GrepCount    int                 // number of greps started
+	GrepRegexp   *regexp.Regexp      // regexp of grep shown in grep pane
+	Preview      *preview            // replacement in files to be written
+	PreviewCount int                 // number of replacement previews started
+	PaneCount    int                 // number of panes given IDs
+	RemotePane   int                 // ID of pane given by remote request
+	Replace      *replaceRun         // replacement in progress, if any
+	Search       *search             // incremental search in progress, if any
+	Count        *matchCount         // match count in progress, if any
+	WordRegexp   *regexp.Regexp      // regexp of last word under cursor
+	SearchKey    string              // pattern and options of SearchRegexp
+	SearchRegexp *regexp.Regexp      // compiled last search, if valid
+	HistSearch   *historySearch      // history search in progress, if any
+	Visit        func()              // visit awaiting confirmation, if any
+	PromptNote   string              // message shown after prompt input
+	Options      map[string]string   // options set at runtime
+	Chord        string              // incomplete key sequence
+	EatText      bool                // ignore text input from last key press
+	Edit         []editStep          // edit being recorded
+	LastEdit     []editStep          // last complete or current edit
+	EditOpen     bool                // whether Edit can be extended
+	Replaying    bool                // whether LastEdit is being replayed
+
+	MacroName   string         // name of macro being recorded
+	MacroEvents []string       // events of macro being recorded
+	MacroDepth  int            // number of macros currently playing
+	MacroBudget int            // events left to play, or -1 if stopped
+	MacroPanes  map[*Pane]bool // panes grouped for undo during playback
+	LastMacro   string         // name of last recorded or played macro
+
+	Cancelled bool // whether the user quit without confirmation
 }
 
 // render redraws and updates the display.
@@ -321,7 +419,8 @@ func render(rc *RenderContext) {
 		}
 	}()
 	paneFocused := rc.Focus == rc.Pane.Buffer
-	drawBuffer(rc.Pane.Buffer, rc.Font, surf, paneFocused)
-	drawStatusLine(surf, rc.Font, rc.Status, rc.Input, rc.Pane, !paneFocused)
+	drawBuffer(rc.Pane, rc.Font, surf, paneFocused, rc.highlightRegexps())
+	drawStatusLine(surf, rc.Font, rc.Status, rc.PromptNote, rc.Input, rc.Pane,
+		!paneFocused)
 	rc.Window.UpdateSurface()
 }
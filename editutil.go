@@ -2,47 +2,99 @@ package main
 
 import (
 	"regexp"
+	"unicode/utf8"
 
 	"github.com/jangler/edit"
 )
 
+// wrappedStatus is the status message for a search that wrapped around.
+const wrappedStatus = "Search wrapped."
+
 var (
 	spaceRegexp = regexp.MustCompile(`\s`)
 	wordRegexp  = regexp.MustCompile(`\w`)
 )
 
-// find attempts a regexp search in the buffer and returns a status message.
+// find moves the selection to the next or previous match of re in the buffer
+// and returns a status message. The search is limited to the range marked for
+// searching if the inselection option is set, and continues from the other end
+// of the range if the wrapsearch option is set.
 func find(b *edit.Buffer, re *regexp.Regexp, forward bool,
 	defaultStatus string) string {
 	if re == nil {
 		return "No pattern to find."
 	}
 
-	sel, ins := b.IndexFromMark(selMark), b.IndexFromMark(insMark)
+	start, end := searchRange(b)
+	sel, ins := order(b.IndexFromMark(selMark), b.IndexFromMark(insMark))
 	if forward {
-		_, index := order(sel, ins)
-		text := b.Get(index, b.End())
-		if loc := re.FindStringIndex(text); loc != nil {
-			b.Mark(b.ShiftIndex(index, loc[0]), selMark)
-			b.Mark(b.ShiftIndex(index, loc[1]), insMark)
-			b.Separate()
-		} else {
-			return "No forward match."
+		if ins.Less(start) {
+			ins = start
 		}
-	} else {
-		index, _ := order(sel, ins)
-		text := b.Get(edit.Index{1, 0}, index)
-		if locs := re.FindAllStringIndex(text, -1); locs != nil {
-			loc := locs[len(locs)-1]
-			b.Mark(b.ShiftIndex(edit.Index{1, 0}, loc[0]), selMark)
-			b.Mark(b.ShiftIndex(edit.Index{1, 0}, loc[1]), insMark)
-			b.Separate()
-		} else {
-			return "No backward match."
+		if !end.Less(ins) && findIn(b, re, ins, end, true) {
+			return defaultStatus
 		}
+		if wrapsearchFlag && findIn(b, re, start, end, true) {
+			return wrappedStatus
+		}
+		return "No forward match."
+	}
+	if end.Less(sel) {
+		sel = end
+	}
+	if !sel.Less(start) && findIn(b, re, start, sel, false) {
+		return defaultStatus
 	}
+	if wrapsearchFlag && findIn(b, re, start, end, false) {
+		return wrappedStatus
+	}
+	return "No backward match."
+}
 
-	return defaultStatus
+// findIn selects the first match of re between start and end in the buffer,
+// or the last match if first is false, and returns false if there is no match.
+func findIn(b *edit.Buffer, re *regexp.Regexp, start, end edit.Index,
+	first bool) bool {
+	text := b.Get(start, end)
+	var loc []int
+	if first {
+		loc = re.FindStringIndex(text)
+	} else if locs := re.FindAllStringIndex(text, -1); locs != nil {
+		loc = locs[len(locs)-1]
+	}
+	if loc == nil {
+		return false
+	}
+	from := b.ShiftIndex(start, utf8.RuneCountInString(text[:loc[0]]))
+	b.Mark(from, selMark)
+	b.Mark(b.ShiftIndex(from, utf8.RuneCountInString(text[loc[0]:loc[1]])),
+		insMark)
+	return true
+}
+
+// searchRange returns the range of the buffer that searches cover: the range
+// marked for searching if the inselection option is set and the range is not
+// empty, or else the whole buffer.
+func searchRange(b *edit.Buffer) (start, end edit.Index) {
+	if inselectionFlag {
+		start, end = b.IndexFromMark(rangeStartMark),
+			b.IndexFromMark(rangeEndMark)
+		if start.Less(end) {
+			return
+		}
+	}
+	return edit.Index{1, 0}, b.End()
+}
+
+// markSearchRange marks the selection as the range for searches, unless the
+// selection is empty or already within the marked range.
+func markSearchRange(b *edit.Buffer) {
+	sel, ins := order(b.IndexFromMark(selMark), b.IndexFromMark(insMark))
+	start, end := b.IndexFromMark(rangeStartMark), b.IndexFromMark(rangeEndMark)
+	if sel != ins && (sel.Less(start) || end.Less(ins) || !start.Less(end)) {
+		b.Mark(sel, rangeStartMark)
+		b.Mark(ins, rangeEndMark)
+	}
 }
 
 // getSelection returns the selected text in the buffer.
@@ -118,17 +170,24 @@ func selectLine(b *edit.Buffer, line int) {
 
 // selectWord selects the word at the given index in the buffer.
 func selectWord(b *edit.Buffer, index edit.Index) {
-	selIndex, insIndex := index, index
+	selIndex, insIndex := wordBounds(b, index)
+	b.Mark(selIndex, selMark)
+	b.Mark(insIndex, insMark)
+}
+
+// wordBounds returns the start and end of the word at the given index in the
+// buffer, which are equal if there is no word there.
+func wordBounds(b *edit.Buffer, index edit.Index) (start, end edit.Index) {
+	start, end = index, index
 	for wordRegexp.MatchString(b.Get(
-		edit.Index{selIndex.Line, selIndex.Char - 1}, selIndex)) {
-		selIndex.Char--
+		edit.Index{start.Line, start.Char - 1}, start)) {
+		start.Char--
 	}
 	for wordRegexp.MatchString(b.Get(
-		insIndex, edit.Index{insIndex.Line, insIndex.Char + 1})) {
-		insIndex.Char++
+		end, edit.Index{end.Line, end.Char + 1})) {
+		end.Char++
 	}
-	b.Mark(selIndex, selMark)
-	b.Mark(insIndex, insMark)
+	return
 }
 
 // shiftIndexByWord returns the given index shifted forward by n words. A
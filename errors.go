@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/jangler/edit"
+)
+
+const outputTitle = "+Output"
+
+// errorRegexp matches compiler-style error lines of the form
+// "file:line:col: message", where the column is optional.
+var errorRegexp = regexp.MustCompile(
+	`^((?:[A-Za-z]:)?[^:\s][^:]*):(\d+):(?:(\d+):)?\s*(.*)$`)
+
+// outputError is a location parsed from a line of command output.
+type outputError struct {
+	outLine   int // line of the output pane
+	path      string
+	line, col int // col is zero if not given
+	msg       string
+}
+
+// outputErrors returns the error locations listed in the output pane p.
+func outputErrors(p *Pane) []outputError {
+	var errs []outputError
+	for i := 1; i <= p.End().Line; i++ {
+		text := p.Get(edit.Index{i, 0}, edit.Index{i, 1 << 30})
+		if subs := errorRegexp.FindStringSubmatch(text); subs != nil {
+			e := outputError{outLine: i, path: subs[1], msg: subs[4]}
+			e.line, _ = strconv.Atoi(subs[2])
+			e.col, _ = strconv.Atoi(subs[3])
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// goToError selects the next error in the output pane after the last one
+// visited, or the previous error if backward is true, and opens its location.
+func (rc *RenderContext) goToError(backward bool) {
+	out := rc.findPane(outputTitle)
+	if out == nil {
+		rc.Status = "No command output."
+		return
+	}
+	errs := outputErrors(out)
+	i := -1
+	for j, e := range errs {
+		if backward && e.outLine < rc.ErrorLine ||
+			!backward && e.outLine > rc.ErrorLine && i < 0 {
+			i = j
+		}
+	}
+	if i < 0 {
+		rc.Status = "No more errors."
+		return
+	}
+	e := errs[i]
+	rc.ErrorLine = e.outLine
+	selectLine(out.Buffer, e.outLine)
+	seeMark(out.Buffer, insMark, out.Rows)
+
+	rc.confirmVisit(e.path, func() {
+		// select the location
+		p := rc.Pane
+		line := e.line
+		if line < 1 {
+			line = 1
+		} else if line > p.End().Line {
+			line = p.End().Line
+		}
+		if e.col > 0 {
+			p.Mark(edit.Index{line, e.col - 1}, selMark, insMark)
+			selectWord(p.Buffer, p.IndexFromMark(insMark))
+		} else {
+			selectLine(p.Buffer, line)
+		}
+		seeMark(p.Buffer, insMark, p.Rows)
+		rc.Status = fmt.Sprintf("Error %d of %d: %s", i+1, len(errs), e.msg)
+	})
+}
+
+func nextError(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.goToError(false)
+	}
+	return true
+}
+
+func prevError(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.goToError(true)
+	}
+	return true
+}
+
+// build runs the build command of the file's INI section.
+func build(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	p := rc.Panes[0]
+	section := fileSection(p.Title,
+		p.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30}))
+	if cmdString := sectionFlags[section]["build"]; section != "" &&
+		cmdString != "" {
+		rc.Status = rc.runCmd(cmdString)
+	} else {
+		rc.Status = "No build command for this filetype."
+	}
+	return true
+}
@@ -2,26 +2,17 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-	"io/ioutil"
-	"path/filepath"
+	"errors"
+	"log"
+	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"github.com/jangler/edit"
 	"github.com/veandco/go-sdl2/sdl"
 	"github.com/veandco/go-sdl2/sdl_ttf"
 )
 
-// user event types. these are only vars in order to be addressable.
-var (
-	pipeEvent   = 1
-	statusEvent = 2
-)
-
-var userEventType uint32 // set at beginning of event loop
-
 // colRowFromXY converts (x, y) coordinates in a window to a row and column.
 func colRowFromXY(winHeight, x, y int) (col, row int) {
 	ps := paneSpace(winHeight)
@@ -51,7 +42,8 @@ func click(b *edit.Buffer, winHeight, x, y, times int, shift bool) {
 }
 
 // clickFind moves the cursor and selection to the next or previous instance of
-// the selected text, and returns a status message,
+// the selected text, according to the search options, and returns a status
+// message.
 func clickFind(b *edit.Buffer, shift bool, winHeight, x, y int,
 	defaultStatus string) string {
 	x, y = colRowFromXY(winHeight, x, y)
@@ -71,32 +63,11 @@ func clickFind(b *edit.Buffer, shift bool, winHeight, x, y int,
 		selectWord(b, sel)
 		sel, ins = b.IndexFromMark(selMark), b.IndexFromMark(insMark)
 	}
-	selection := b.Get(sel, ins)
-
-	if shift { // search backwards
-		index := sel
-		text := b.Get(edit.Index{1, 0}, index)
-		if pos := strings.LastIndex(text, selection); pos >= 0 {
-			b.Mark(b.ShiftIndex(index, pos-utf8.RuneCountInString(text)),
-				selMark)
-			b.Mark(b.ShiftIndex(b.IndexFromMark(selMark),
-				utf8.RuneCountInString(selection)), insMark)
-		} else {
-			return "No backward match."
-		}
-	} else { // search forwards
-		index := ins
-		text := b.Get(index, b.End())
-		if pos := strings.Index(text, selection); pos >= 0 {
-			b.Mark(b.ShiftIndex(index, pos), selMark)
-			b.Mark(b.ShiftIndex(b.IndexFromMark(selMark),
-				utf8.RuneCountInString(selection)), insMark)
-		} else {
-			return "No forward match."
-		}
+	re, err := compileSearch(b.Get(sel, ins), true)
+	if err != nil {
+		return err.Error()
 	}
-
-	return defaultStatus
+	return find(b, re, !shift, defaultStatus)
 }
 
 // deleteCharOrTab deletes a single character, or may delete a tabstop worth of
@@ -144,18 +115,26 @@ func resize(pane *Pane, width, height int) {
 	pane.SetSize(cols, rows)
 }
 
-// saveFile writes the contents of pane to a file with the name of the pane's
-// title.
-func saveFile(pane *Pane) error {
+// paneText returns the contents of pane as they should be written to a file.
+func paneText(pane *Pane) string {
 	text := pane.Get(edit.Index{1, 0}, pane.End()) + "\n"
 	if pane.LineEnding != "\n" {
 		text = strings.Replace(text, "\n", pane.LineEnding, -1)
 	}
-	path, err := filepath.Abs(expandVars(pane.Title))
-	if err != nil {
-		return err
+	return text
+}
+
+// saveFile writes the contents of pane to a file with the name of the pane's
+// title.
+func saveFile(pane *Pane) error {
+	if filterFlag && pane.Title == stdinTitle {
+		return errors.New("Quit to write to standard output.")
 	}
-	err = ioutil.WriteFile(path, []byte(text), 0664)
+	if pane.Scratch {
+		return errors.New("Buffer is not associated with a file.")
+	}
+	text := paneText(pane)
+	err := writeFile(expandVars(pane.Title), []byte(text))
 	if err == nil {
 		pane.ResetModified()
 	}
@@ -172,457 +151,125 @@ func warpMouseToSel(w *sdl.Window, b *edit.Buffer) {
 	w.WarpMouseInWindow(int(x), int(y))
 }
 
-// getHistory gets the appropriate history for the given prompt.
+// getHistory gets the appropriate history for the given prompt. Each prompt
+// has its own history, except that the Find prompts share one.
 func getHistory(histories map[string]*history, prompt string) *history {
-	key := strings.Split(prompt, " ")[0]
+	key := prompt
+	if prompt == findBackwardPrompt {
+		key = findForwardPrompt
+	}
 	if histories[key] == nil {
-		histories[key] = &history{}
+		histories[key] = loadHistory(key)
 	}
 	return histories[key]
 }
 
-// eventLoop handles SDL events until quit is requested.
-func eventLoop(pane *Pane, status string, font *ttf.Font, win *sdl.Window) {
-	userEventType = sdl.RegisterEvents(1)
-	rc := &RenderContext{pane, edit.NewBuffer(), pane.Buffer, status, font,
-		win, nil}
+// keyDown processes a key press, returning whether the key was recognized and
+// false for ok if the application should quit.
+func (rc *RenderContext) keyDown(keysym sdl.Keysym) (recognized, ok bool) {
+	recording := rc.MacroName != "" && rc.MacroDepth == 0
+	prevSel := rc.Pane.IndexFromMark(selMark)
+	prevIns := rc.Pane.IndexFromMark(insMark)
+	searching := rc.Search != nil // which keeps its own view
+	if rc.Focus == rc.Pane.Buffer {
+		rc.Status = rc.Pane.Title
+	}
+	ok = true
+	if name, shift, bound := rc.lookupKey(keysym); bound {
+		recognized = true
+		ok = rc.runCommand(name, shift)
+		rc.updateHistorySearch(name)
+		rc.updateSearch()
+	} else if rc.Chord != "" || rc.EatText {
+		recognized = true
+	}
+	if recognized {
+		if recording && rc.MacroName != "" {
+			rc.MacroEvents = append(rc.MacroEvents, keySpec(keysym))
+		}
+		if !searching && (prevSel != rc.Pane.IndexFromMark(selMark) ||
+			prevIns != rc.Pane.IndexFromMark(insMark)) {
+			seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+		}
+	}
+	return
+}
+
+// textEvent processes text input.
+func (rc *RenderContext) textEvent(s string) {
+	if rc.MacroName != "" && rc.MacroDepth == 0 {
+		rc.MacroEvents = append(rc.MacroEvents, strconv.Quote(s))
+	}
+	if rc.EatText {
+		rc.EatText = false // key press was part of a sequence
+		return
+	}
+	if rc.Focus == rc.Input && rc.Status == replaceAskPrompt {
+		rc.replaceAnswer(s) // answer without Enter
+		return
+	}
+	rc.typeText(s)
+	rc.updateHistorySearch("")
+	rc.updateSearch()
+	if rc.Focus == rc.Pane.Buffer {
+		seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+	}
+}
+
+// deleteBlankLine deletes the line at prevIns in pane if it contains only
+// whitespace, the cursor has moved away from it, and pane is still displayed.
+// Read-only and terminal panes are left alone.
+func (rc *RenderContext) deleteBlankLine(pane *Pane, prevIns edit.Index) {
+	if pane != rc.Pane || pane.ReadOnly || pane.Term != nil {
+		return
+	}
+	if prevIns.Line != rc.Pane.IndexFromMark(insMark).Line {
+		line := rc.Pane.Get(edit.Index{prevIns.Line, 0},
+			edit.Index{prevIns.Line, 1 << 30})
+		if len(strings.TrimSpace(line)) == 0 {
+			rc.Pane.Delete(edit.Index{prevIns.Line, 0},
+				edit.Index{prevIns.Line, 1 << 30})
+		}
+	}
+}
+
+// eventLoop handles SDL events until quit is requested. Returns false if the
+// user quit without confirmation.
+func eventLoop(pane *Pane, status string, font *ttf.Font,
+	win *sdl.Window) bool {
+	wakeupEventType = sdl.RegisterEvents(1)
+	rc := &RenderContext{Pane: pane, Input: edit.NewBuffer(),
+		Focus: pane.Buffer, Status: status, Font: font, Window: win,
+		Histories: make(map[string]*history), Panes: []*Pane{pane},
+		Options: make(map[string]string)}
 	rc.Input.Mark(edit.Index{1, 0}, selMark, insMark)
+	defer rc.killJobs() // their output would be lost anyway
+
+	// wait for history entries made just before quitting to be saved
+	defer pendingSaves.Wait()
+	if l, err := listenRemote(); err == nil {
+		defer l.Close()
+	} else {
+		log.Print(err)
+	}
 	render(rc)
 	w, h := win.GetSize()
 	win.SetSize(w, h)
 	clickCount := 0
 	lastClick := time.Now()
 	var rightClickIndex edit.Index
-	histories := make(map[string]*history)
 
 	for {
-		// get current marks to see if they change based on the event
-		prevSel := rc.Pane.IndexFromMark(selMark)
-		prevIns := rc.Pane.IndexFromMark(insMark)
+		// get current mark to see if it changes based on the event
+		prevPane, prevIns := rc.Pane, rc.Pane.IndexFromMark(insMark)
 
 		switch event := sdl.WaitEvent().(type) {
 		case *sdl.KeyDownEvent:
-			if rc.Focus == rc.Pane.Buffer {
-				rc.Status = rc.Pane.Title
-			}
-			recognized := true
-			switch event.Keysym.Sym {
-			case sdl.K_BACKSPACE:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					end := rc.Focus.IndexFromMark(insMark)
-					begin := shiftIndexByWord(rc.Focus, end, -1)
-					rc.Focus.Delete(begin, end)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					if sel := rc.Focus.IndexFromMark(selMark); sel != index {
-						rc.Focus.Delete(order(sel, index))
-					} else {
-						deleteCharOrTab(rc.Focus, index, -1)
-					}
-				}
-			case sdl.K_DELETE:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					begin := rc.Focus.IndexFromMark(insMark)
-					end := shiftIndexByWord(rc.Focus, begin, 1)
-					rc.Focus.Delete(begin, end)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					if sel := rc.Focus.IndexFromMark(selMark); sel != index {
-						rc.Focus.Delete(order(sel, index))
-					} else {
-						deleteCharOrTab(rc.Focus, index, 1)
-					}
-				}
-				if rc.Focus == rc.Pane.Buffer {
-					seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
-				}
-			case sdl.K_DOWN:
-				if rc.Focus == rc.Pane.Buffer {
-					index := rc.Focus.IndexFromMark(insMark)
-					col, row := rc.Focus.CoordsFromIndex(index)
-					rc.Focus.Mark(rc.Focus.IndexFromCoords(col, row+1),
-						insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					rc.Pane.Separate()
-				} else {
-					input := getHistory(histories, rc.Status).next()
-					rc.Input.Delete(edit.Index{1, 0}, rc.Input.End())
-					rc.Input.Insert(edit.Index{1, 0}, input)
-				}
-			case sdl.K_ESCAPE:
-				if rc.Focus == rc.Input {
-					rc.Status = rc.Pane.Title
-					rc.Focus = rc.Pane.Buffer
-				}
-			case sdl.K_END:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					rc.Focus.Mark(rc.Focus.End(), insMark)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(edit.Index{index.Line, 1 << 30}, insMark)
-				}
-				if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-					rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
-				}
-				if rc.Focus == rc.Pane.Buffer {
-					rc.Pane.Separate()
-				}
-			case sdl.K_LEFT:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					index = shiftIndexByWord(rc.Focus, index, -1)
-					rc.Focus.Mark(index, insMark)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(rc.Focus.ShiftIndex(index, -1), insMark)
-				}
-				if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-					rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
-				}
-				if rc.Focus == rc.Pane.Buffer {
-					rc.Pane.Separate()
-				}
-			case sdl.K_HOME:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					rc.Focus.Mark(edit.Index{1, 0}, insMark)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(edit.Index{index.Line, 0}, insMark)
-				}
-				if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-					rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
-				}
-				if rc.Focus == rc.Pane.Buffer {
-					rc.Pane.Separate()
-				}
-			case sdl.K_PAGEDOWN:
-				if rc.Focus == rc.Pane.Buffer {
-					index := rc.Pane.IndexFromMark(insMark)
-					col, row := rc.Pane.CoordsFromIndex(index)
-					rc.Pane.Mark(rc.Pane.IndexFromCoords(col,
-						row+rc.Pane.Rows), insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					rc.Pane.Separate()
-				}
-			case sdl.K_PAGEUP:
-				if rc.Focus == rc.Pane.Buffer {
-					index := rc.Pane.IndexFromMark(insMark)
-					col, row := rc.Pane.CoordsFromIndex(index)
-					rc.Pane.Mark(rc.Pane.IndexFromCoords(col,
-						row-rc.Pane.Rows), insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					rc.Pane.Separate()
-				}
-			case sdl.K_RETURN:
-				if rc.Focus == rc.Pane.Buffer {
-					textInput(rc.Focus, "\n")
-				} else {
-					input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
-					getHistory(histories, rc.Status).appendString(input)
-					if !rc.EnterInput() {
-						return
-					}
-				}
-			case sdl.K_RIGHT:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					index = shiftIndexByWord(rc.Focus, index, 1)
-					rc.Focus.Mark(index, insMark)
-				} else {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(rc.Focus.ShiftIndex(index, 1), insMark)
-				}
-				if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-					rc.Focus.Mark(rc.Focus.IndexFromMark(insMark), selMark)
-				}
-				if rc.Focus == rc.Pane.Buffer {
-					rc.Pane.Separate()
-				}
-			case sdl.K_TAB:
-				if rc.Focus == rc.Pane.Buffer {
-					sel := rc.Pane.IndexFromMark(selMark)
-					ins := rc.Pane.IndexFromMark(insMark)
-					if sel == ins {
-						char := rc.Pane.Buffer.Get(
-							edit.Index{ins.Line, ins.Char - 1}, ins)
-						if char == "" || char == " " || char == "\t" {
-							// insert tab
-							if expandtabFlag {
-								for i := 0; i < int(tabstopFlag); i++ {
-									textInput(rc.Focus, " ")
-								}
-							} else {
-								textInput(rc.Focus, "\t")
-							}
-						} else {
-							// complete word
-							selectWord(rc.Focus, ins)
-							word := getSelection(rc.Focus)
-							forward := event.Keysym.Mod&sdl.KMOD_SHIFT != 0
-							completion := completeWord(rc.Focus, word, forward)
-							if completion != "" {
-								textInput(rc.Focus, completion)
-							} else {
-								rc.Status = "No completions."
-							}
-							rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-								selMark)
-						}
-					} else {
-						// indent/unindent selection
-						sel, ins := order(sel, ins)
-						unindent := event.Keysym.Mod&sdl.KMOD_SHIFT != 0
-						indent(rc.Pane.Buffer, sel.Line, ins.Line, unindent)
-					}
-				} else {
-					input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
-					input = expandVars(input)
-					switch rc.Status {
-					case cdPrompt:
-						input = completePath(input, true)
-					case openPrompt, openNewPrompt, saveAsPrompt:
-						input = completePath(input, false)
-					case pipePrompt, runPrompt:
-						tokens := strings.Split(input, " ")
-						for i, token := range tokens {
-							if i == 0 {
-								tokens[i] = completeCmd(token)
-							} else {
-								tokens[i] = completePath(token, false)
-							}
-						}
-						input = strings.Join(tokens, " ")
-					}
-					rc.Input.Delete(edit.Index{1, 0}, rc.Input.End())
-					rc.Input.Insert(edit.Index{1, 0}, input)
-				}
-			case sdl.K_UP:
-				if rc.Focus == rc.Pane.Buffer {
-					index := rc.Focus.IndexFromMark(insMark)
-					col, row := rc.Focus.CoordsFromIndex(index)
-					rc.Focus.Mark(rc.Focus.IndexFromCoords(col, row-1),
-						insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					rc.Pane.Separate()
-				} else {
-					input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
-					input = getHistory(histories, rc.Status).prev(input)
-					rc.Input.Delete(edit.Index{1, 0}, rc.Input.End())
-					rc.Input.Insert(edit.Index{1, 0}, input)
-				}
-			case sdl.K_a:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(edit.Index{index.Line, 0}, insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					if rc.Focus == rc.Pane.Buffer {
-						rc.Pane.Separate()
-					}
-				}
-			case sdl.K_c:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if rc.Focus == rc.Input {
-						rc.Status = rc.Pane.Title
-						rc.Focus = rc.Pane.Buffer
-					} else {
-						sdl.SetClipboardText(getSelection(rc.Pane.Buffer))
-						rc.Status = "Copied text."
-					}
-				}
-			case sdl.K_d:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					rc.Prompt(cdPrompt)
-				}
-			case sdl.K_e:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Mark(edit.Index{index.Line, 1 << 30}, insMark)
-					if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 {
-						rc.Focus.Mark(rc.Focus.IndexFromMark(insMark),
-							selMark)
-					}
-					if rc.Focus == rc.Pane.Buffer {
-						rc.Pane.Separate()
-					}
-				}
-			case sdl.K_f:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						rc.Prompt(findBackwardPrompt)
-					} else {
-						rc.Prompt(findForwardPrompt)
-					}
-				}
-			case sdl.K_g:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					rc.Prompt(goToLinePrompt)
-				}
-			case sdl.K_h:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					deleteCharOrTab(rc.Focus, index, -1)
-				}
-			case sdl.K_i:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					textInput(rc.Focus, "\t")
-				}
-			case sdl.K_l:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					if rc.Pane.LineEnding == "\n" {
-						rc.Pane.LineEnding = "\r\n"
-						rc.Status = "Using DOS line endings."
-					} else {
-						rc.Pane.LineEnding = "\n"
-						rc.Status = "Using Unix line endings."
-					}
-				}
-			case sdl.K_n:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						rc.Status = find(rc.Pane.Buffer, rc.Regexp, false,
-							rc.Status)
-					} else {
-						rc.Status = find(rc.Pane.Buffer, rc.Regexp, true,
-							rc.Status)
-					}
-				}
-			case sdl.K_o:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						rc.Prompt(openNewPrompt)
-					} else {
-						if rc.Pane.Modified() {
-							rc.Prompt(reallyOpenPrompt)
-						} else {
-							rc.Prompt(openPrompt)
-						}
-					}
-				}
-			case sdl.K_p:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					rc.Prompt(pipePrompt)
-				}
-			case sdl.K_q:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if rc.Focus == rc.Pane.Buffer {
-						if event.Keysym.Mod&sdl.KMOD_SHIFT == 0 &&
-							rc.Pane.Modified() {
-							rc.Prompt(reallyQuitPrompt)
-						} else {
-							return
-						}
-					} else {
-						rc.Status = rc.Pane.Title
-						rc.Focus = rc.Pane.Buffer
-					}
-				}
-			case sdl.K_r:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						rc.Font = getFont()
-						rc.Status = "Reloaded font."
-					} else if rc.Focus != rc.Input {
-						rc.Prompt(runPrompt)
-					}
-				}
-			case sdl.K_s:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 &&
-					rc.Focus != rc.Input {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						rc.Prompt(saveAsPrompt)
-					} else {
-						if err := saveFile(rc.Pane); err == nil {
-							rc.Status = fmt.Sprintf(`Saved "%s".`,
-								rc.Pane.Title)
-							if rc.Pane.LineEnding == "\r\n" {
-								rc.Status += " [DOS]"
-							}
-						} else {
-							rc.Status = err.Error()
-						}
-					}
-				}
-			case sdl.K_u:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					index := rc.Focus.IndexFromMark(insMark)
-					rc.Focus.Delete(edit.Index{index.Line, 0}, index)
-				}
-			case sdl.K_v:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					text, err := sdl.GetClipboardText()
-					if err != nil {
-						rc.Status = err.Error()
-						break
-					}
-					sel := rc.Focus.IndexFromMark(selMark)
-					insert := rc.Focus.IndexFromMark(insMark)
-					if sel != insert {
-						rc.Focus.Delete(order(sel, insert))
-						insert, _ = order(sel, insert)
-					}
-					rc.Focus.Insert(insert, text)
-				}
-			case sdl.K_w:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					end := rc.Focus.IndexFromMark(insMark)
-					begin := shiftIndexByWord(rc.Focus, end, -1)
-					rc.Focus.Delete(begin, end)
-				}
-			case sdl.K_x:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					sel := rc.Focus.IndexFromMark(selMark)
-					insert := rc.Focus.IndexFromMark(insMark)
-					sdl.SetClipboardText(rc.Focus.Get(order(sel, insert)))
-					rc.Focus.Delete(order(sel, insert))
-				}
-
-			case sdl.K_y:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if !rc.Pane.Redo(selMark, insMark) {
-						rc.Status = "Nothing to redo."
-					}
-				}
-			case sdl.K_z:
-				if event.Keysym.Mod&sdl.KMOD_CTRL != 0 {
-					if event.Keysym.Mod&sdl.KMOD_SHIFT != 0 {
-						if !rc.Pane.Redo(selMark, insMark) {
-							rc.Status = "Nothing to redo."
-						}
-					} else {
-						if !rc.Pane.Undo(selMark, insMark) {
-							rc.Status = "Nothing to undo."
-						}
-					}
-				}
-			default:
-				recognized = false
+			recognized, ok := rc.keyDown(event.Keysym)
+			if !ok {
+				return !rc.Cancelled
 			}
 			if recognized {
-				if prevSel != rc.Pane.IndexFromMark(selMark) ||
-					prevIns != rc.Pane.IndexFromMark(insMark) {
-					seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
-				}
 				render(rc)
 			}
 		case *sdl.MouseButtonEvent:
@@ -632,6 +279,7 @@ func eventLoop(pane *Pane, status string, font *ttf.Font, win *sdl.Window) {
 			state := sdl.GetKeyboardState()
 			shift := state[sdl.SCANCODE_LSHIFT]|state[sdl.SCANCODE_RSHIFT] != 0
 			if event.Type == sdl.MOUSEBUTTONDOWN {
+				rc.EditOpen = false
 				if event.Button == sdl.BUTTON_LEFT {
 					if time.Since(lastClick) < time.Second/4 {
 						clickCount = clickCount%3 + 1
@@ -651,10 +299,16 @@ func eventLoop(pane *Pane, status string, font *ttf.Font, win *sdl.Window) {
 			} else if event.Type == sdl.MOUSEBUTTONUP &&
 				event.Button == sdl.BUTTON_RIGHT {
 				_, winHeight := rc.Window.GetSize()
-				rc.Status = clickFind(rc.Pane.Buffer, shift, winHeight,
-					int(event.X), int(event.Y), rc.Status)
-				seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
-				warpMouseToSel(rc.Window, rc.Pane.Buffer)
+				if rc.Pane.Kind == grepPane {
+					x, y := colRowFromXY(winHeight, int(event.X),
+						int(event.Y))
+					rc.openGrepHit(rc.Pane.IndexFromCoords(x, y).Line)
+				} else {
+					rc.Status = clickFind(rc.Pane.Buffer, shift, winHeight,
+						int(event.X), int(event.Y), rc.Status)
+					seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+					warpMouseToSel(rc.Window, rc.Pane.Buffer)
+				}
 				render(rc)
 			}
 			rc.Pane.Separate()
@@ -677,32 +331,25 @@ func eventLoop(pane *Pane, status string, font *ttf.Font, win *sdl.Window) {
 			rc.Pane.Scroll(int(event.Y) * -3)
 			render(rc)
 		case *sdl.QuitEvent:
-			return
+			// closing the window kills jobs only if the user confirms
+			if !rc.runningJobs() {
+				return true
+			}
+			if rc.Focus == rc.Input {
+				rc.cancelPrompt()
+			}
+			rc.Prompt(reallyQuitJobsPrompt)
+			render(rc)
 		case *sdl.TextInputEvent:
 			if n := bytes.Index(event.Text[:], []byte{0}); n > 0 {
-				textInput(rc.Focus, string(event.Text[:n]))
-				if rc.Focus == rc.Pane.Buffer {
-					seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
-				}
+				rc.textEvent(string(event.Text[:n]))
 				render(rc)
 			}
 		case *sdl.UserEvent:
-			switch *(*int)(event.Data1) {
-			case pipeEvent:
-				sel := rc.Focus.IndexFromMark(selMark)
-				ins := rc.Focus.IndexFromMark(insMark)
-				rc.Pane.Delete(order(sel, ins))
-				ins, _ = order(sel, ins)
-				rc.Pane.Insert(ins, *(*string)(event.Data2))
-				seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+			if event.Type == wakeupEventType {
+				rc.receiveMessages()
 				render(rc)
-			case statusEvent:
-				if rc.Focus != rc.Input {
-					rc.Status = *(*string)(event.Data2)
-					render(rc)
-				}
 			}
-			enableGC()
 		case *sdl.WindowEvent:
 			switch event.Event {
 			case sdl.WINDOWEVENT_EXPOSED, sdl.WINDOWEVENT_SHOWN:
@@ -713,14 +360,6 @@ func eventLoop(pane *Pane, status string, font *ttf.Font, win *sdl.Window) {
 			}
 		}
 
-		// delete lines containing only whitespace when moving cursor away
-		if prevIns.Line != rc.Pane.IndexFromMark(insMark).Line {
-			line := rc.Pane.Get(edit.Index{prevIns.Line, 0},
-				edit.Index{prevIns.Line, 1 << 30})
-			if len(strings.TrimSpace(line)) == 0 {
-				rc.Pane.Delete(edit.Index{prevIns.Line, 0},
-					edit.Index{prevIns.Line, 1 << 30})
-			}
-		}
+		rc.deleteBlankLine(prevPane, prevIns)
 	}
 }
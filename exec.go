@@ -1,29 +1,22 @@
 package main
 
 import (
-	"encoding/base32"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"math/rand"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"time"
-	"unsafe"
+	"unicode/utf8"
 
-	"github.com/veandco/go-sdl2/sdl"
+	"github.com/jangler/edit"
 )
 
 var shellName, shellOpt string // command interpreter invocation
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
-
 	if runtime.GOOS == "windows" {
 		shellName, shellOpt = "cmd", "/c"
 	} else {
@@ -32,20 +25,27 @@ func init() {
 }
 
 // flags returns a []string of command line flags that have been set in a form
-// that can be passed as arguments to exec.Command().
+// that can be passed as arguments to exec.Command(). Flags that only make sense
+// for the original instance are omitted.
 func flags() []string {
-	args := make([]string, flag.NFlag())
-	i := 0
+	var args []string
 	flag.Visit(func(f *flag.Flag) {
-		args[i] = fmt.Sprintf("-%s=%v", f.Name, f.Value)
-		i++
+		if !cmdLineFlags[f.Name] {
+			args = append(args, fmt.Sprintf("-%s=%v", f.Name, f.Value))
+		}
 	})
 	return args
 }
 
 // newInstance opens a new instane of Fervor editing the given filename and
-// returns a status message.
+// returns a status message. If another instance has the file open, its window
+// is raised instead.
 func newInstance(filename, defaultStatus string) string {
+	if c := raiseRemote(filename); c != nil {
+		c.close()
+		return fmt.Sprintf(`"%s" is open in another window.`,
+			minPath(filename))
+	}
 	cmd := exec.Command(os.Args[0], append(flags(), filename)...)
 	if err := cmd.Start(); err != nil {
 		return err.Error()
@@ -53,107 +53,204 @@ func newInstance(filename, defaultStatus string) string {
 	return defaultStatus
 }
 
-// reportExitStatus pushes a status message to the SDL event queue depending
-// on err (which may be nil).
+// commandEnv returns the environment of commands run from prompts, which
+// includes the path of this instance's socket as $FERVOR_SOCKET and the ID of
+// the pane they were run from as $FERVOR_PANE.
+func commandEnv(paneID int) []string {
+	env := os.Environ()
+	if remoteSocket != "" {
+		env = append(env, "FERVOR_SOCKET="+remoteSocket,
+			"FERVOR_PANE="+strconv.Itoa(paneID))
+	}
+	return env
+}
+
+// reportExitStatus passes a status message to the event loop depending on err
+// (which may be nil).
 func reportExitStatus(cmd string, err error) {
-	var event sdl.UserEvent
-	var msg string
 	if err == nil {
-		msg = fmt.Sprintf(`Command "%s" exited successfully.`, cmd)
+		postMessage(statusMessage(fmt.Sprintf(
+			`Command "%s" exited successfully.`, cmd)))
 	} else {
-		msg = fmt.Sprintf(`Command "%s" exited with error: %v`, cmd, err)
+		postMessage(statusMessage(fmt.Sprintf(
+			`Command "%s" exited with error: %v`, cmd, err)))
+	}
+}
+
+// pipeJob is a job whose output replaces the selection in a pane as the output
+// arrives.
+type pipeJob struct {
+	*job
+	pane     *Pane
+	inserted int        // number of characters of output inserted so far
+	repeat   bool       // whether the command is part of a repeated edit
+	rest     []editStep // steps of the repeated edit after the command
+}
+
+// pipeOutput is output from a pipe command, passed to the event loop.
+type pipeOutput struct {
+	job  *pipeJob
+	text string
+	done bool // whether the command has exited
+}
+
+// utf8Prefix returns the length of the longest prefix of data that does not
+// end with an incomplete UTF-8 sequence.
+func utf8Prefix(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
 	}
-	event.Type, event.Data1 = userEventType, unsafe.Pointer(&statusEvent)
-	disableGC()
-	event.Data2 = unsafe.Pointer(&msg)
-	sdl.PushEvent(&event)
+	return len(data)
 }
 
-// pipeCmd pipes selection through cmdString asynchronously and returns a
-// status message. Results are returned on the SDL event queue.
-func pipeCmd(cmdString, selection, defaultStatus string) string {
+// pipeCmd starts piping the selection of the current pane through cmdString
+// and returns a status message. The selection is replaced by the command's
+// output as it arrives on the SDL event queue, as a single undoable action.
+// The pane can't be edited until the command exits.
+func (rc *RenderContext) pipeCmd(cmdString string) string {
+	p := rc.Pane
+	if p.Pipe != nil {
+		return fmt.Sprintf(`Command "%s" is still running.`, p.Pipe.cmdString)
+	}
+
 	// initialize command
 	cmd := exec.Command(shellName, shellOpt, cmdString)
-	inPipe, err := cmd.StdinPipe()
-	if err != nil {
-		return err.Error()
-	}
+	cmd.Env = commandEnv(rc.paneID(p))
+	cmd.Stdin = strings.NewReader(getSelection(p.Buffer))
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return err.Error()
 	}
-	if err := cmd.Start(); err != nil {
+	j, err := rc.startJob(cmdString, cmd)
+	if err != nil {
 		return err.Error()
 	}
 
-	go func() {
-		// write to stdin and read from stdout
-		go func() {
-			if _, err := io.WriteString(inPipe, selection); err != nil {
-				log.Print(err)
-			}
-			inPipe.Close()
-		}()
-		var outBytes []byte
-		go func() {
-			if outBytes, err = ioutil.ReadAll(outPipe); err != nil {
-				log.Print(err)
-			}
-		}()
-
-		reportExitStatus(cmdString, cmd.Wait())
-
-		if outBytes != nil {
-			// strip trailing newline
-			if len(outBytes) > 0 && outBytes[len(outBytes)-1] == '\n' {
-				outBytes = outBytes[:len(outBytes)-1]
-			}
+	// output is inserted at pipeMark, in place of the selection
+	p.Separate()
+	start, end := order(p.IndexFromMark(selMark), p.IndexFromMark(insMark))
+	p.Delete(start, end)
+	p.Mark(start, pipeMark)
+	p.Pipe = &pipeJob{job: j, pane: p}
+	go p.Pipe.read(outPipe)
+	return rc.Status
+}
 
-			// push pipe event
-			output := string(outBytes)
-			var event sdl.UserEvent
-			event.Type = userEventType
-			event.Data1 = unsafe.Pointer(&pipeEvent)
-			disableGC()
-			event.Data2 = unsafe.Pointer(&output)
-			sdl.PushEvent(&event)
+// read passes output from the command to the event loop until the command
+// exits. A trailing newline at the end of the output is dropped.
+func (j *pipeJob) read(r io.Reader) {
+	buf := make([]byte, 4096)
+	var rest []byte      // incomplete UTF-8 sequence at end of last read
+	heldNewline := false // whether a newline was held back from last output
+	for {
+		n, err := r.Read(buf)
+		data := append(rest, buf[:n]...)
+		valid := len(data)
+		if err == nil {
+			valid = utf8Prefix(data)
+		}
+		text := string(data[:valid])
+		rest = append([]byte(nil), data[valid:]...)
+		if heldNewline {
+			text = "\n" + text
+		}
+		if heldNewline = strings.HasSuffix(text, "\n"); heldNewline {
+			text = text[:len(text)-1]
 		}
-	}()
+		if text != "" {
+			postMessage(&pipeOutput{job: j, text: text})
+		}
+		if err != nil {
+			break
+		}
+	}
+	postMessage(&jobExit{job: j.job, err: j.cmd.Wait()})
+	postMessage(&pipeOutput{job: j, done: true})
+}
 
-	return defaultStatus
+// pipeEvent processes output from a pipe command.
+func (rc *RenderContext) pipeEvent(out *pipeOutput) {
+	p := out.job.pane
+	if p.Pipe != out.job {
+		return // pane was closed
+	}
+	if out.done {
+		p.Pipe = nil
+		if out.job.repeat {
+			rc.replaySteps(p, out.job.rest)
+		} else {
+			p.Separate()
+		}
+		return
+	}
+	index := p.IndexFromMark(pipeMark)
+	if p.Regions != nil {
+		p.Regions.sync(p.Buffer)
+	}
+	p.Insert(index, out.text)
+	out.job.inserted += len([]rune(out.text))
+	if p.Regions != nil {
+		// the output may not be near the cursor
+		p.Regions.changed(index.Line, p.IndexFromMark(pipeMark).Line,
+			p.End().Line)
+	}
+	if p.Scratch {
+		p.ResetModified()
+	}
+	if p == rc.Pane {
+		seeMark(p.Buffer, insMark, p.Rows)
+	}
 }
 
-// runCmd executes cmdString asynchronously. Results are returned on the SDL
-// event queue.
-func runCmd(cmdString string) {
-	cmd := exec.Command(shellName, shellOpt, cmdString)
+// killCmd kills the command piping into the current pane.
+func killCmd(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	if rc.Pane.Pipe == nil {
+		rc.Status = "No command is running."
+	} else if err := rc.Pane.Pipe.kill(); err != nil {
+		rc.Status = err.Error()
+	} else {
+		rc.Status = fmt.Sprintf(`Killed "%s".`, rc.Pane.Pipe.cmdString)
+	}
+	return true
+}
 
-	go func() {
-		output, err := cmd.CombinedOutput()
-		reportExitStatus(cmdString, err)
+// runCmd executes cmdString asynchronously and returns a status message. The
+// command's output and errors are shown in the output pane as they arrive.
+func (rc *RenderContext) runCmd(cmdString string) string {
+	p := rc.findPane(outputTitle)
+	if p == nil {
+		p = newScratchPane(outputTitle, "")
+	} else if p.Pipe != nil {
+		return fmt.Sprintf(`Command "%s" is still running.`, p.Pipe.cmdString)
+	}
 
-		if output != nil && len(output) > 0 {
-			// generate a random filename
-			src := make([]byte, 8)
-			for i := range src {
-				src[i] = byte(rand.Intn(256))
-			}
-			name := base32.StdEncoding.EncodeToString(src)
-			name = strings.TrimRight(name, "=")
-
-			// write command output to temp file
-			path := filepath.Join(os.TempDir(), name)
-			file, err := os.Create(path)
-			if err != nil {
-				log.Print(err)
-				return
-			}
-			file.Write(output)
-			file.Close()
+	// initialize command
+	cmd := exec.Command(shellName, shellOpt, cmdString)
+	cmd.Env = commandEnv(rc.paneID(rc.Pane))
+	outPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err.Error()
+	}
+	cmd.Stderr = cmd.Stdout
+	j, err := rc.startJob(cmdString, cmd)
+	if err != nil {
+		return err.Error()
+	}
 
-			// open temp file in new window, then clean up
-			exec.Command(os.Args[0], append(flags(), path)...).Run()
-			defer os.Remove(path)
-		}
-	}()
+	// output replaces the previous contents of the output pane
+	p.Delete(edit.Index{1, 0}, p.End())
+	p.Mark(edit.Index{1, 0}, selMark, insMark, pipeMark)
+	p.Pipe = &pipeJob{job: j, pane: p}
+	go p.Pipe.read(outPipe)
+	rc.ErrorLine = 0
+	rc.showPane(p)
+	return rc.Status
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jangler/edit"
+)
+
+const (
+	grepTitle   = "+Grep"
+	maxGrepHits = 10000 // number of hits shown in the grep pane
+	binaryBytes = 8000  // number of bytes checked for NULs to detect binaries
+)
+
+// grepLineRegexp matches a line of the grep pane.
+var grepLineRegexp = regexp.MustCompile(`^(.+?):(\d+): `)
+
+// grepResult is the result of a grep, passed to the event loop.
+type grepResult struct {
+	id    int // number of the grep, to discard the results of old ones
+	re    *regexp.Regexp
+	lines []string // lines of the grep pane
+	files int      // number of files with hits
+	err   error
+}
+
+// ignoreRule is a pattern from a .gitignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp // matches paths relative to dir
+	dir     string         // directory containing the .gitignore file
+	negate  bool           // whether the pattern begins with "!"
+	dirOnly bool           // whether the pattern ends with "/"
+}
+
+// globRegexp converts a gitignore glob into a regexp matching paths relative
+// to the directory of the .gitignore file. Patterns without a slash match at
+// any depth.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+	var b bytes.Buffer
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(?:^|/)")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 0 {
+				class := glob[i+1 : i+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += j
+			} else {
+				b.WriteString(`\[`)
+			}
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// readIgnoreRules returns the rules in a .gitignore-style file. dir is the
+// directory that the rules apply to, relative to the root of the search.
+func readIgnoreRules(path, dir string) []ignoreRule {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		if rule.re, err = globRegexp(line); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ignored returns true if the path, relative to the root of the search, is
+// ignored by rules. Later rules take precedence.
+func ignored(rules []ignoreRule, path string, isDir bool) bool {
+	ignore := false
+	for _, rule := range rules {
+		rel := path
+		if rule.dir != "." {
+			if !strings.HasPrefix(path, rule.dir+"/") {
+				continue
+			}
+			rel = path[len(rule.dir)+1:]
+		}
+		if (!rule.dirOnly || isDir) && rule.re.MatchString(rel) {
+			ignore = !rule.negate
+		}
+	}
+	return ignore
+}
+
+// readTextFile returns the contents of the file at path, or false if the file
+// can't be read or is binary.
+func readTextFile(path string) (string, bool) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	head := contents
+	if len(head) > binaryBytes {
+		head = head[:binaryBytes]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", false
+	}
+	return string(contents), true
+}
+
+// walkFiles calls fn in parallel for each file under the working directory,
+// skipping .git directories and paths ignored by .gitignore files. Paths are
+// relative to the working directory and use forward slashes.
+func walkFiles(fn func(path string)) error {
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				fn(path)
+			}
+		}()
+	}
+
+	rules := readIgnoreRules(filepath.Join(".git", "info", "exclude"), ".")
+	err := filepath.Walk(".", func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return nil // skip unreadable paths
+		}
+		path = filepath.ToSlash(path)
+		if info.IsDir() {
+			if path != "." && (info.Name() == ".git" ||
+				ignored(rules, path, true)) {
+				return filepath.SkipDir
+			}
+			rules = append(rules, readIgnoreRules(
+				filepath.Join(path, ".gitignore"), path)...)
+		} else if info.Mode().IsRegular() && !ignored(rules, path, false) {
+			paths <- path
+		}
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+	return err
+}
+
+// grepFile returns the lines of the file at path that match re, formatted for
+// the grep pane. Binary files have no matching lines.
+func grepFile(path string, re *regexp.Regexp) []string {
+	contents, ok := readTextFile(path)
+	if !ok {
+		return nil
+	}
+	var lines []string
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if re.MatchString(line) {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", path, i+1, line))
+		}
+	}
+	return lines
+}
+
+// grepFiles searches the files under the working directory for lines matching
+// re.
+func grepFiles(re *regexp.Regexp) *grepResult {
+	results := make(map[string][]string)
+	var mu sync.Mutex
+	err := walkFiles(func(path string) {
+		if lines := grepFile(path, re); lines != nil {
+			mu.Lock()
+			results[path] = lines
+			mu.Unlock()
+		}
+	})
+
+	// sort hits by path, then line
+	res := &grepResult{re: re, files: len(results), err: err}
+	var sorted []string
+	for path := range results {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		res.lines = append(res.lines, results[path]...)
+	}
+	return res
+}
+
+// grep prompts for a regexp to search for in files.
+func grep(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(grepPrompt)
+	}
+	return true
+}
+
+// startGrep searches files for pattern in the background and returns a status
+// message. The results are shown in the grep pane.
+func (rc *RenderContext) startGrep(pattern string) string {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err.Error()
+	}
+	rc.GrepCount++
+	id := rc.GrepCount
+	go func() {
+		res := grepFiles(re)
+		res.id = id
+		postMessage(res)
+	}()
+	return fmt.Sprintf(`Searching files for "%s"...`, pattern)
+}
+
+// grepDone shows the results of the latest grep in the grep pane.
+func (rc *RenderContext) grepDone(res *grepResult) {
+	if res.id != rc.GrepCount {
+		return
+	}
+	if res.err != nil {
+		rc.Status = res.err.Error()
+		return
+	}
+	if len(res.lines) == 0 {
+		rc.Status = "No matches."
+		return
+	}
+	rc.GrepRegexp = res.re
+	status := fmt.Sprintf("%d matches in %d files.", len(res.lines),
+		res.files)
+	if len(res.lines) > maxGrepHits {
+		res.lines = res.lines[:maxGrepHits]
+		status += fmt.Sprintf(" Showing the first %d.", maxGrepHits)
+	}
+
+	p := rc.findPane(grepTitle)
+	if p == nil {
+		p = newScratchPane(grepTitle, "")
+		p.Kind = grepPane
+	}
+	p.Delete(edit.Index{1, 0}, p.End())
+	p.Insert(edit.Index{1, 0}, strings.Join(res.lines, "\n"))
+	p.ResetModified()
+	p.ResetUndo()
+	p.Mark(edit.Index{1, 0}, selMark, insMark)
+	rc.showPane(p)
+	rc.Status = status
+}
+
+// openGrepHit opens the file of the hit on a line of the grep pane and selects
+// the match.
+func (rc *RenderContext) openGrepHit(line int) {
+	p := rc.Pane
+	text := p.Get(edit.Index{line, 0}, edit.Index{line, 1 << 30})
+	subs := grepLineRegexp.FindStringSubmatch(text)
+	if subs == nil {
+		return
+	}
+	selectLine(p.Buffer, line)
+	n, _ := strconv.Atoi(subs[2])
+	rc.confirmVisit(subs[1], func() {
+		p := rc.Pane
+		start, end := edit.Index{n, 0}, edit.Index{n, 1 << 30}
+		if rc.GrepRegexp == nil || !findIn(p.Buffer, rc.GrepRegexp, start,
+			end, true) {
+			selectLine(p.Buffer, n)
+		}
+		seeMark(p.Buffer, insMark, p.Rows)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jangler/edit"
+)
+
+// helpTitle is the title of the help pane.
+const helpTitle = "+Help"
+
+// mouseHelp describes the mouse bindings, which are not configurable.
+var mouseHelp = [][2]string{
+	{"Left click", "Position cursor"},
+	{"Left double-click", "Select word"},
+	{"Left triple-click", "Select line"},
+	{"Left drag", "Select text"},
+	{"Right click", "Find next instance of clicked word or selection"},
+	{"Right drag", "Find next instance of selection"},
+	{"Wheel", "Scroll"},
+}
+
+// promptHelp describes the prompts that commands can open.
+var promptHelp = [][2]string{
+	{cdPrompt, "Directory; Tab completes"},
+	{findBackwardPrompt, "Regular expression"},
+	{findForwardPrompt, "Regular expression"},
+	{goToLinePrompt, "Line number"},
+	{grepPrompt, "Regular expression"},
+	{jobsPrompt, "kill ID, kill all, or timeout ID SECONDS"},
+	{openPrompt, "File path; Tab completes"},
+	{openNewPrompt, "File path; Tab completes"},
+	{pipePrompt, "Shell command; Tab completes"},
+	{playMacroPrompt, "Macro name, optionally preceded by a count"},
+	{reallyOpenPrompt, "y or n"},
+	{reallyQuitPrompt, "y or n"},
+	{reallyQuitJobsPrompt, "y or n"},
+	{reallyVisitPrompt, "y or n"},
+	{recordMacroPrompt, "Macro name"},
+	{replacePrompt, "Regular expression"},
+	{replaceWithPrompt, "Replacement; $1 or ${name} inserts a group"},
+	{replaceModePrompt, "a (all), s (in selection), or i (interactive)"},
+	{replaceAskPrompt, "y (replace), n (skip), a (all), or q (stop)"},
+	{replaceFilesPrompt, "Regular expression"},
+	{replaceFilesWithPrompt, "Replacement; $1 or ${name} inserts a group"},
+	{runPrompt, "Shell command; Tab completes"},
+	{saveAsPrompt, "File path; Tab completes"},
+	{setPrompt, "name=value, or name to show value; Tab completes"},
+	{terminalPrompt, "Shell command, or nothing for a shell; Tab completes"},
+}
+
+// helpText returns the contents of the help pane, generated from the current
+// key bindings, flags, and INI settings. section is the name of the INI
+// section that applies to the file being edited.
+func helpText(section string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Fervor %s help.", version)
+	if keys := keysFor("help", "quit"); keys != nil {
+		fmt.Fprintf(&b, " Press %s to return to the file.",
+			strings.Join(keys, " or "))
+	}
+	b.WriteString("\n")
+	if keys := keysFor("find-forward"); keys != nil {
+		fmt.Fprintf(&b, "Use %s to search this buffer.\n",
+			strings.Join(keys, " or "))
+	}
+
+	b.WriteString("\nKey bindings\n\n")
+	bound := make(map[string]bool)
+	for _, keys := range sortedBindings() {
+		name := bindings[keys]
+		bound[name] = true
+		fmt.Fprintf(&b, "\t%-16s %-22s %s\n", keys, name, commands[name].desc)
+	}
+	var unbound []string
+	for name := range commands {
+		if !bound[name] {
+			unbound = append(unbound, name)
+		}
+	}
+	if len(unbound) > 0 {
+		sort.Strings(unbound)
+		b.WriteString("\nUnbound commands\n\n")
+		for _, name := range unbound {
+			fmt.Fprintf(&b, "\t%-22s %s\n", name, commands[name].desc)
+		}
+	}
+	b.WriteString("\nHolding Shift makes a cursor motion select text. " +
+		"Bindings are changed in the\n[keys] section of the INI file, as in " +
+		"\"Ctrl+K Ctrl+C=copy\".\n")
+
+	b.WriteString("\nMouse bindings\n\n")
+	for _, m := range mouseHelp {
+		fmt.Fprintf(&b, "\t%-18s %s\n", m[0], m[1])
+	}
+	b.WriteString("\nHolding Shift makes a left click extend the selection, " +
+		"and makes a right\nclick or drag search backward.\n")
+
+	b.WriteString("\nPrompts\n\n")
+	for _, p := range promptHelp {
+		fmt.Fprintf(&b, "\t%-26s %s\n", strings.TrimSpace(p[0]), p[1])
+	}
+	b.WriteString("\nUp and Down browse prompt history, which leaves out " +
+		"input that begins\nwith a space. Ctrl+R searches the " +
+		"history for the input as it is typed,\nfinding older matches " +
+		"when repeated. Esc or Ctrl+C cancels. The Find prompts\n" +
+		"search as you type and show the search options that are set.\n")
+
+	b.WriteString("\nOptions\n\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		value := fmt.Sprintf("%s=%s", f.Name, f.Value)
+		fmt.Fprintf(&b, "\t%-20s %s", value, f.Usage)
+		if f.DefValue != f.Value.String() {
+			fmt.Fprintf(&b, " (default %s)", f.DefValue)
+		}
+		b.WriteString("\n")
+	})
+	b.WriteString("\nOptions can be given on the command line as " +
+		"-name=value, or in ~/fervor.ini or\n~/.config/fervor.ini as " +
+		"name=value. Filetype sections of the INI file also\naccept " +
+		"filename= and shebang=, which list semicolon-separated patterns " +
+		"that\nselect the section, and build=, the command run by the " +
+		"build command. Most\noptions can also be changed for the rest " +
+		"of the session using the Set prompt.\nColors can be changed in " +
+		"the [colors] section, or by selecting a theme.\n")
+
+	b.WriteString("\nActive filetype section\n\n")
+	if flags, ok := sectionFlags[section]; ok && section != "" {
+		fmt.Fprintf(&b, "\t%s\n", section)
+		keys := make([]string, 0, len(flags))
+		for k := range flags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "\t%s=%s\n", k, flags[k])
+		}
+	} else {
+		b.WriteString("\tNone.\n")
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// help shows the help pane, or returns to the previous pane if the help pane
+// is already displayed.
+func help(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	}
+	if rc.Pane.Title == helpTitle {
+		rc.closePane()
+		return true
+	}
+	text := helpText(fileSection(rc.Pane.Title,
+		rc.Pane.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30})))
+	p := rc.findPane(helpTitle)
+	if p == nil {
+		p = newScratchPane(helpTitle, text)
+	} else {
+		p.Delete(edit.Index{1, 0}, p.End())
+		p.Insert(edit.Index{1, 0}, text)
+		p.ResetModified()
+		p.ResetUndo()
+		p.Mark(edit.Index{1, 0}, selMark, insMark)
+	}
+	rc.showPane(p)
+	return true
+}
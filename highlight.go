@@ -0,0 +1,267 @@
+package main
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/jangler/edit"
+)
+
+// region is a syntax rule for text that can continue across lines, such as a
+// block comment. Text matching skip within the region cannot end it. If start
+// or end has a group named "region", only the text in that group of the match
+// belongs to the region.
+type region struct {
+	start, end, skip *regexp.Regexp
+	id               int
+}
+
+// regionRules are the multi-line syntax rules for a filetype. Text matching
+// skip, such as a string or line comment, cannot begin a region.
+type regionRules struct {
+	regions []region
+	skip    *regexp.Regexp
+}
+
+// span is a range of a line that belongs to a region.
+type span struct {
+	start, end int
+	id         int
+}
+
+// fileRegions returns the multi-line syntax rules for a file, or nil if its
+// filetype has none.
+func fileRegions(path, line string) *regionRules {
+	if regionFunc, ok := regionMap[fileSection(path, line)]; ok {
+		return regionFunc()
+	}
+	return nil
+}
+
+// afterRune caches, for each regexp, a regexp that matches any character
+// followed by a match of the original as its first group.
+var afterRune = make(map[*regexp.Regexp]*regexp.Regexp)
+
+// matchFrom returns the locations of the first non-empty match of re in text
+// that begins at or after pos and of its groups, or nil if there is none.
+// Past the start of the line, matching begins at the character before pos, so
+// that anchors like ^ and \b see what precedes pos.
+func matchFrom(re *regexp.Regexp, text string, pos int) []int {
+	if re == nil {
+		return nil
+	}
+	for {
+		var loc []int
+		if pos == 0 {
+			loc = re.FindStringSubmatchIndex(text)
+		} else {
+			after := afterRune[re]
+			if after == nil {
+				after = regexp.MustCompile(`(?s:.)(` + re.String() + `)`)
+				afterRune[re] = after
+			}
+			_, size := utf8.DecodeLastRuneInString(text[:pos])
+			if m := after.FindStringSubmatchIndex(text[pos-size:]); m != nil {
+				loc = m[2:]
+				for i := range loc {
+					if loc[i] >= 0 {
+						loc[i] += pos - size
+					}
+				}
+			}
+		}
+		if loc == nil {
+			return nil
+		}
+		if loc[1] > loc[0] {
+			return loc
+		}
+		if loc[0] == len(text) {
+			return nil
+		}
+		_, size := utf8.DecodeRuneInString(text[loc[0]:])
+		pos = loc[0] + size // past the empty match
+	}
+}
+
+// inRegion returns the part of a match of re at loc that belongs to a region.
+func inRegion(re *regexp.Regexp, loc []int) (int, int) {
+	if i := re.SubexpIndex("region"); i > 0 && loc[2*i] >= 0 {
+		return loc[2*i], loc[2*i+1]
+	}
+	return loc[0], loc[1]
+}
+
+// findEnd returns the byte offset following the end of the region in text,
+// searching from pos, or -1 if the region does not end on this line.
+func (r region) findEnd(text string, pos int) int {
+	for {
+		end := matchFrom(r.end, text, pos)
+		if skip := matchFrom(r.skip, text, pos); skip != nil &&
+			(end == nil || skip[0] < end[0]) {
+			pos = skip[1]
+			continue
+		}
+		if end == nil {
+			return -1
+		}
+		_, e := inRegion(r.end, end)
+		return e
+	}
+}
+
+// scan returns the region open at the end of a line and the byte ranges of
+// the line that belong to regions, given the region open at the start of the
+// line. Regions are identified by index, or -1 for no region.
+func (rules *regionRules) scan(text string, state int) (int, []span) {
+	var spans []span
+	pos, spanStart := 0, 0
+	for {
+		if state >= 0 {
+			r := rules.regions[state]
+			end := r.findEnd(text, pos)
+			if end < 0 {
+				return state, append(spans, span{spanStart, len(text), r.id})
+			}
+			if end > spanStart {
+				spans = append(spans, span{spanStart, end, r.id})
+			}
+			pos, state = end, -1
+		}
+
+		// find the earliest region start; ties go to the first region
+		start, begin, end, next := -1, -1, -1, -1
+		for i, r := range rules.regions {
+			if loc := matchFrom(r.start, text, pos); loc != nil &&
+				(start < 0 || loc[0] < start) {
+				start, end, next = loc[0], loc[1], i
+				begin, _ = inRegion(r.start, loc)
+			}
+		}
+		if skip := matchFrom(rules.skip, text, pos); skip != nil &&
+			(start < 0 || skip[0] < start) {
+			pos = skip[1]
+			continue
+		}
+		if start < 0 {
+			return -1, spans
+		}
+		state, spanStart, pos = next, begin, end
+	}
+}
+
+// highlighter tracks the region open at the start of each line of a pane, so
+// that only lines near an edit need to be scanned again.
+type highlighter struct {
+	rules    *regionRules
+	states   []int      // states[i] is the region open at the start of line i+1
+	valid    int        // number of states known to be correct
+	known    int        // number of states computed, correct if unaffected
+	checkTo  int        // last line that must be scanned before stopping early
+	lines    int        // number of lines in the buffer at the last sync
+	sel, ins edit.Index // marks at the last sync
+}
+
+// newHighlighter returns a highlighter for b using rules, or nil if rules is
+// nil.
+func newHighlighter(b *edit.Buffer, rules *regionRules) *highlighter {
+	if rules == nil {
+		return nil
+	}
+	h := &highlighter{rules: rules}
+	h.reset(b)
+	return h
+}
+
+// reset discards all computed states. It should be called after edits that
+// may not be near the cursor, like playing a macro.
+func (h *highlighter) reset(b *edit.Buffer) {
+	h.states, h.valid, h.known, h.checkTo = []int{-1}, 1, 1, 0
+	h.lines = b.End().Line
+	h.sel, h.ins = b.IndexFromMark(selMark), b.IndexFromMark(insMark)
+}
+
+// sync accounts for edits made to b since the last sync. Edits are assumed to
+// lie between the lines of the marks before and after the edits.
+func (h *highlighter) sync(b *edit.Buffer) {
+	sel, ins := b.IndexFromMark(selMark), b.IndexFromMark(insMark)
+	from, to := sel.Line, sel.Line
+	for _, line := range []int{ins.Line, h.sel.Line, h.ins.Line} {
+		if line < from {
+			from = line
+		}
+		if line > to {
+			to = line
+		}
+	}
+	h.changed(from, to, b.End().Line)
+	h.sel, h.ins = sel, ins
+}
+
+// changed accounts for an edit to lines from through to, after which the
+// buffer has the given number of lines.
+func (h *highlighter) changed(from, to, lines int) {
+	delta := lines - h.lines
+	if to < from+delta {
+		to = from + delta
+	}
+	if to > lines {
+		to = lines
+	}
+
+	if h.valid > h.checkTo {
+		h.checkTo = to
+	} else if h.checkTo += delta; h.checkTo < to {
+		h.checkTo = to
+	}
+	valid := h.valid
+	if from < valid {
+		valid = from
+	}
+	if delta != 0 {
+		// lines after to were previously at to-delta
+		states := append([]int(nil), h.states[:valid]...)
+		if valid == from && to-delta >= from && to-delta < h.known {
+			for len(states) < to {
+				states = append(states, -1)
+			}
+			states = append(states, h.states[to-delta:h.known]...)
+		}
+		h.states, h.known = states, len(states)
+	}
+	h.valid, h.lines = valid, lines
+}
+
+// update computes the states of lines up to last. Scanning stops early once
+// the state at the start of a line matches its previously computed state.
+func (h *highlighter) update(b *edit.Buffer, last int) {
+	for h.valid < last {
+		line := h.valid
+		text := b.Get(edit.Index{line, 0}, edit.Index{line, 1 << 30})
+		state, _ := h.rules.scan(text, h.states[line-1])
+		if line < h.known {
+			if line > h.checkTo && h.states[line] == state {
+				h.valid = h.known
+				continue
+			}
+			h.states[line] = state
+		} else {
+			h.states, h.known = append(h.states[:line], state), line+1
+		}
+		h.valid++
+	}
+}
+
+// lineSpans returns the column ranges of a line that belong to regions. The
+// line's state must have been computed by update.
+func (h *highlighter) lineSpans(b *edit.Buffer, line int) []span {
+	text := b.Get(edit.Index{line, 0}, edit.Index{line, 1 << 30})
+	_, spans := h.rules.scan(text, h.states[line-1])
+	for i, s := range spans {
+		spans[i].start, _ = b.CoordsFromIndex(edit.Index{line,
+			utf8.RuneCountInString(text[:s.start])})
+		spans[i].end, _ = b.CoordsFromIndex(edit.Index{line,
+			utf8.RuneCountInString(text[:s.end])})
+	}
+	return spans
+}
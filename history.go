@@ -1,13 +1,215 @@
 package main
 
-import "container/list"
+import (
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jangler/edit"
+)
+
+const (
+	maxHistory = 1000             // entries kept in each saved history
+	staleLock  = 10 * time.Second // age at which a lock file is ignored
+)
 
 // history represents a command history.
 type history struct {
+	key     string     // prompt, or the prompt whose history it shares
 	entries *list.List // list of string
 	current *list.Element
 }
 
+// historySearch is the state of a reverse search of a prompt's history.
+type historySearch struct {
+	input string        // input last searched for
+	match *list.Element // entry last found, if any
+}
+
+// savedHistories maps the prompts whose histories are saved to the names of
+// the files they are saved in. Other histories last only for the session.
+var savedHistories = map[string]string{
+	cdPrompt:               "cd",
+	findForwardPrompt:      "find", // shared with findBackwardPrompt
+	grepPrompt:             "grep",
+	openNewPrompt:          "open-new",
+	openPrompt:             "open",
+	pipePrompt:             "pipe",
+	replaceFilesPrompt:     "replace-files",
+	replaceFilesWithPrompt: "replace-files-with",
+	replacePrompt:          "replace",
+	replaceWithPrompt:      "replace-with",
+	runPrompt:              "run",
+	terminalPrompt:         "terminal",
+}
+
+// historySave is an entry to add to a history file. Once the entry is saved,
+// it is passed to the event loop along with the merged entries of the file.
+type historySave struct {
+	h       *history
+	path    string
+	entry   string
+	entries []string // of the file, oldest first
+	err     error
+}
+
+var (
+	historySaves = make(chan *historySave, 64) // in the order entered
+	saverOnce    sync.Once                     // starts saveHistories
+	pendingSaves sync.WaitGroup                // entries not yet saved
+)
+
+// historyPath returns the path of the file that the history with the given
+// key is saved to, or an empty string if the history isn't saved.
+func historyPath(key string) (string, error) {
+	name, ok := savedHistories[key]
+	if !ok {
+		return "", nil
+	}
+	if dataDir() == "" {
+		return "", errors.New("No data directory for history.")
+	}
+	return filepath.Join(dataDir(), "history", name), nil
+}
+
+// readHistory returns the entries saved in a history file, oldest first. Each
+// line of the file is a quoted entry.
+func readHistory(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if s, err := strconv.Unquote(line); err == nil {
+			entries = append(entries, s)
+		}
+	}
+	return entries, nil
+}
+
+// loadHistory returns the history with the given key, containing the entries
+// saved by this and other instances.
+func loadHistory(key string) *history {
+	h := &history{key: key, entries: list.New()}
+	if path, _ := historyPath(key); path != "" {
+		entries, _ := readHistory(path)
+		for _, s := range entries {
+			h.entries.PushBack(s)
+		}
+	}
+	return h
+}
+
+// lockFile waits until no other instance holds the lock on path, and takes it.
+// The returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	lock := path + ".lock"
+	for tries := 0; ; tries++ {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil &&
+			time.Since(fi.ModTime()) > staleLock {
+			os.Remove(lock) // left by an instance that didn't exit cleanly
+		} else if tries >= 100 {
+			return nil, errors.New("Timed out waiting for " + lock)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// add appends s to the history, and if the history is saved, adds s to its
+// file in the background.
+func (h *history) add(s string) {
+	h.appendString(s)
+	if s == "" {
+		return
+	}
+	path, err := historyPath(h.key)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if path != "" {
+		saverOnce.Do(func() { go saveHistories() })
+		pendingSaves.Add(1)
+		historySaves <- &historySave{h: h, path: path, entry: s}
+	}
+}
+
+// saveHistories saves entries to history files in the order they were added.
+func saveHistories() {
+	for hs := range historySaves {
+		hs.entries, hs.err = saveEntry(hs.path, hs.entry)
+		pendingSaves.Done()
+		postMessage(hs)
+	}
+}
+
+// saveEntry adds s to the end of the history file at path, removing any
+// earlier copy of s, and returns the entries of the file. Entries saved by
+// other instances are kept.
+func saveEntry(path, s string) ([]string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	saved, err := readHistory(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var entries, lines []string
+	for _, e := range saved {
+		if e != s {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, s)
+	if len(entries) > maxHistory {
+		entries = entries[len(entries)-maxHistory:]
+	}
+	for _, e := range entries {
+		lines = append(lines, strconv.Quote(e)+"\n")
+	}
+	return entries, writeFileSafely(path, []byte(strings.Join(lines, "")))
+}
+
+// historySaved replaces the entries of a history with those of its file once
+// an entry has been saved, so that it includes the entries of other instances.
+// A history that is being browsed or searched is left alone.
+func (rc *RenderContext) historySaved(hs *historySave) {
+	if hs.err != nil {
+		log.Print(hs.err)
+		return
+	}
+	if hs.h.current != nil || rc.HistSearch != nil {
+		return
+	}
+	hs.h.entries.Init()
+	for _, e := range hs.entries {
+		hs.h.entries.PushBack(e)
+	}
+}
+
 // appendString adds s to the list of history entries if s is not already the
 // last entry.
 func (h *history) appendString(s string) {
@@ -57,3 +259,74 @@ func (h *history) next() string {
 	}
 	return ""
 }
+
+// search returns the newest entry containing s that is older than e, or the
+// newest entry containing s if e is nil.
+func (h *history) search(s string, e *list.Element) *list.Element {
+	if h.entries == nil {
+		return nil
+	}
+	if e == nil {
+		e = h.entries.Back()
+	} else {
+		e = e.Prev()
+	}
+	for ; e != nil; e = e.Prev() {
+		if strings.Contains(e.Value.(string), s) {
+			return e
+		}
+	}
+	return nil
+}
+
+// searchHistory starts a reverse search of the prompt's history for the
+// prompt input, or finds the next older match if a search is in progress.
+// The match is shown as a note in the status line.
+func (rc *RenderContext) searchHistory() {
+	hs := rc.HistSearch
+	if hs == nil {
+		hs = &historySearch{input: rc.Input.Get(edit.Index{1, 0},
+			rc.Input.End())}
+		rc.HistSearch = hs
+	}
+	h := getHistory(rc.Histories, rc.Status)
+	if e := h.search(hs.input, hs.match); e != nil {
+		hs.match = e
+		rc.PromptNote = "history: " + e.Value.(string)
+	} else if hs.match != nil {
+		rc.PromptNote = "no older match: " + hs.match.Value.(string)
+	} else {
+		rc.PromptNote = "no match in history"
+	}
+}
+
+// updateHistorySearch continues a history search after the named command,
+// or after text input if cmd is empty. If the input has changed, the newest
+// match of the new input is found. Other commands end the search, putting
+// the match in the prompt to be edited.
+func (rc *RenderContext) updateHistorySearch(cmd string) {
+	hs := rc.HistSearch
+	if hs == nil || cmd == "run" {
+		return
+	}
+	input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
+	if input != hs.input {
+		hs.input, hs.match = input, nil
+		rc.searchHistory()
+	} else if cmd != "" {
+		rc.endHistorySearch(true)
+	}
+}
+
+// endHistorySearch ends a history search. If accept is true, the input is
+// replaced by the match, if there is one.
+func (rc *RenderContext) endHistorySearch(accept bool) {
+	hs := rc.HistSearch
+	if hs == nil {
+		return
+	}
+	if accept && hs.match != nil {
+		rc.setInput(hs.match.Value.(string))
+	}
+	rc.HistSearch, rc.PromptNote = nil, ""
+}
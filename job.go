@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jangler/edit"
+)
+
+const (
+	jobsTitle   = "+Jobs"
+	maxDoneJobs = 20 // number of finished jobs kept in the job table
+)
+
+// job is a command run in the background from the Run or Pipe prompt.
+type job struct {
+	id        int
+	cmdString string
+	cmd       *exec.Cmd
+	start     time.Time
+	done      bool  // whether the process has exited
+	err       error // error returned by Wait, if done
+
+	mu       sync.Mutex // guards the fields below, which timers also use
+	killed   bool
+	timedOut bool
+	timer    *time.Timer
+}
+
+// jobExit reports the exit of a job to the event loop.
+type jobExit struct {
+	job *job
+	err error
+}
+
+// startJob starts cmd in its own process group and adds it to the job table.
+// The job is killed after the timeout option, if it is nonzero.
+func (rc *RenderContext) startJob(cmdString string,
+	cmd *exec.Cmd) (*job, error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	rc.JobCount++
+	j := &job{id: rc.JobCount, cmdString: cmdString, cmd: cmd,
+		start: time.Now()}
+	if timeoutFlag > 0 {
+		j.setTimeout(time.Duration(timeoutFlag) * time.Second)
+	}
+
+	// drop the oldest finished jobs
+	done := 0
+	for i := len(rc.Jobs) - 1; i >= 0; i-- {
+		if rc.Jobs[i].done {
+			if done++; done > maxDoneJobs {
+				rc.Jobs = append(rc.Jobs[:i], rc.Jobs[i+1:]...)
+			}
+		}
+	}
+	rc.Jobs = append(rc.Jobs, j)
+	rc.updateJobsPane()
+	return j, nil
+}
+
+// jobExited records the exit of a job and reports it in the status line.
+func (rc *RenderContext) jobExited(exit *jobExit) {
+	j := exit.job
+	j.done, j.err = true, exit.err
+	j.mu.Lock()
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.mu.Unlock()
+	if rc.Focus != rc.Input {
+		rc.Status = j.exitMessage()
+	}
+	rc.updateJobsPane()
+}
+
+// setTimeout kills the job once it has run for d, or removes its timeout if d
+// is zero.
+func (j *job) setTimeout(d time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+	if d > 0 {
+		j.timer = time.AfterFunc(d-time.Since(j.start), func() {
+			j.mu.Lock()
+			j.timedOut = true
+			j.mu.Unlock()
+			j.kill()
+		})
+	}
+}
+
+// kill terminates the job's process group. The first call asks the processes
+// to terminate; later calls kill them outright.
+func (j *job) kill() error {
+	j.mu.Lock()
+	force := j.killed
+	j.killed = true
+	j.mu.Unlock()
+	return killProcessGroup(j.cmd, force)
+}
+
+// state returns a short description of the job's state.
+func (j *job) state() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case !j.done:
+		return "running"
+	case j.timedOut:
+		return "timed out"
+	case j.killed:
+		return "killed"
+	case j.err != nil:
+		return j.err.Error()
+	}
+	return "exited"
+}
+
+// exitMessage returns a status message describing how a finished job exited.
+func (j *job) exitMessage() string {
+	switch state := j.state(); state {
+	case "exited":
+		return fmt.Sprintf(`Command "%s" exited successfully.`, j.cmdString)
+	case "timed out":
+		return fmt.Sprintf(`Command "%s" timed out.`, j.cmdString)
+	case "killed":
+		return fmt.Sprintf(`Command "%s" was killed.`, j.cmdString)
+	}
+	return fmt.Sprintf(`Command "%s" exited with error: %v`, j.cmdString,
+		j.err)
+}
+
+// runningJobs returns true if any job has not exited.
+func (rc *RenderContext) runningJobs() bool {
+	for _, j := range rc.Jobs {
+		if !j.done {
+			return true
+		}
+	}
+	return false
+}
+
+// killJobs kills all running jobs and returns the number of jobs killed.
+func (rc *RenderContext) killJobs() int {
+	n := 0
+	for _, j := range rc.Jobs {
+		if !j.done {
+			j.kill()
+			n++
+		}
+	}
+	return n
+}
+
+// jobsText returns the contents of the jobs pane.
+func (rc *RenderContext) jobsText() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%-4s %-7s %-8s %-12s %s\n", "ID", "PID", "STARTED",
+		"STATE", "COMMAND")
+	for _, j := range rc.Jobs {
+		fmt.Fprintf(&b, "%-4d %-7d %-8s %-12s %s\n", j.id, j.cmd.Process.Pid,
+			j.start.Format("15:04:05"), j.state(), j.cmdString)
+	}
+	return b.String()
+}
+
+// updateJobsPane refreshes the contents of the jobs pane, if it is open.
+func (rc *RenderContext) updateJobsPane() {
+	if p := rc.findPane(jobsTitle); p != nil {
+		ins := p.IndexFromMark(insMark)
+		p.Delete(edit.Index{1, 0}, p.End())
+		p.Insert(edit.Index{1, 0}, rc.jobsText())
+		p.ResetModified()
+		p.ResetUndo()
+		p.Mark(ins, selMark, insMark)
+	}
+}
+
+// listJobs shows the jobs pane and prompts for an action on a job.
+func listJobs(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	p := rc.findPane(jobsTitle)
+	if p == nil {
+		p = newScratchPane(jobsTitle, "")
+	}
+	rc.showPane(p)
+	rc.updateJobsPane()
+	rc.Prompt(jobsPrompt)
+	return true
+}
+
+// findJob returns the job with the ID given by s.
+func (rc *RenderContext) findJob(s string) (*job, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		for _, j := range rc.Jobs {
+			if j.id == id {
+				return j, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No such job: %s", s)
+}
+
+// jobCommand carries out an action entered in the jobs prompt and returns a
+// status message.
+func (rc *RenderContext) jobCommand(input string) string {
+	fields := strings.Fields(input)
+	switch {
+	case len(fields) == 2 && fields[0] == "kill" && fields[1] == "all":
+		if n := rc.killJobs(); n != 1 {
+			return fmt.Sprintf("Killed %d jobs.", n)
+		}
+		return "Killed 1 job."
+	case len(fields) == 2 && fields[0] == "kill":
+		j, err := rc.findJob(fields[1])
+		if err != nil {
+			return err.Error()
+		}
+		if j.done {
+			return fmt.Sprintf(`Command "%s" is not running.`, j.cmdString)
+		}
+		if err := j.kill(); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf(`Killed "%s".`, j.cmdString)
+	case len(fields) == 3 && fields[0] == "timeout":
+		j, err := rc.findJob(fields[1])
+		if err != nil {
+			return err.Error()
+		}
+		if j.done {
+			return fmt.Sprintf(`Command "%s" is not running.`, j.cmdString)
+		}
+		secs, err := strconv.Atoi(fields[2])
+		if err != nil || secs < 0 {
+			return fmt.Sprintf("Invalid timeout: %s", fields[2])
+		}
+		j.setTimeout(time.Duration(secs) * time.Second)
+		if secs == 0 {
+			return fmt.Sprintf(`Removed timeout of "%s".`, j.cmdString)
+		}
+		return fmt.Sprintf(`Set timeout of "%s" to %d seconds.`, j.cmdString,
+			secs)
+	}
+	return `Enter "kill ID", "kill all", or "timeout ID SECONDS".`
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// bindings maps key sequences to command names. A key sequence is one or more
+// space-separated keys, each of which is a key name optionally preceded by
+// "Ctrl+", "Alt+", and/or "Shift+", in that order. The key table in README.md
+// is the output of "fervor -keys" with no .ini file, and should be regenerated
+// when these change.
+var bindings = map[string]string{
+	"Alt+C":          "ignorecase",
+	"Alt+L":          "literal",
+	"Alt+R":          "wrapsearch",
+	"Alt+S":          "inselection",
+	"Alt+W":          "wholeword",
+	"Ctrl+.":         "repeat",
+	"Backspace":      "delete-backward",
+	"Ctrl+A":         "line-start",
+	"Ctrl+Backspace": "delete-word-backward",
+	"Ctrl+C":         "copy",
+	"Ctrl+Shift+C":   "kill",
+	"Ctrl+D":         "cd",
+	"Ctrl+Delete":    "delete-word-forward",
+	"Ctrl+E":         "line-end",
+	"Ctrl+End":       "buffer-end",
+	"Ctrl+F":         "find-forward",
+	"Ctrl+G":         "go-to-line",
+	"Ctrl+H":         "delete-backward",
+	"Ctrl+Home":      "buffer-start",
+	"Ctrl+I":         "insert-tab",
+	"Ctrl+J":         "jobs",
+	"Ctrl+L":         "line-endings",
+	"Ctrl+Left":      "word-left",
+	"Ctrl+M":         "record-macro",
+	"Ctrl+N":         "next-match",
+	"Ctrl+O":         "open",
+	"Ctrl+P":         "pipe",
+	"Ctrl+Q":         "quit",
+	"Ctrl+R":         "run",
+	"Ctrl+Right":     "word-right",
+	"Ctrl+S":         "save",
+	"Ctrl+T":         "set",
+	"Ctrl+Shift+T":   "terminal",
+	"Ctrl+Tab":       "next-buffer",
+	"Ctrl+Shift+F":   "find-backward",
+	"Ctrl+Shift+G":   "grep",
+	"Ctrl+Shift+H":   "replace",
+	"Ctrl+Alt+H":     "replace-files",
+	"Ctrl+Shift+M":   "play-macro",
+	"Ctrl+Shift+N":   "prev-match",
+	"Ctrl+Shift+O":   "open-new",
+	"Ctrl+Shift+Q":   "quit-force",
+	"Ctrl+Shift+R":   "reload-font",
+	"Ctrl+Shift+S":   "save-as",
+	"Ctrl+Shift+Z":   "redo",
+	"Ctrl+U":         "delete-line-backward",
+	"Ctrl+V":         "paste",
+	"Ctrl+W":         "delete-word-backward",
+	"Ctrl+X":         "cut",
+	"Ctrl+Y":         "redo",
+	"Ctrl+Z":         "undo",
+	"Delete":         "delete-forward",
+	"Down":           "down",
+	"End":            "line-end",
+	"Enter":          "enter",
+	"Esc":            "cancel",
+	"F1":             "help",
+	"F5":             "build",
+	"F8":             "next-error",
+	"Shift+F8":       "prev-error",
+	"Home":           "line-start",
+	"Left":           "left",
+	"PgDn":           "page-down",
+	"PgUp":           "page-up",
+	"Right":          "right",
+	"Shift+Tab":      "unindent",
+	"Tab":            "indent",
+	"Up":             "up",
+}
+
+// keyNames maps keycodes to names for keys that aren't named by the character
+// they produce.
+var keyNames = map[sdl.Keycode]string{
+	sdl.K_BACKSPACE: "Backspace",
+	sdl.K_DELETE:    "Delete",
+	sdl.K_DOWN:      "Down",
+	sdl.K_END:       "End",
+	sdl.K_ESCAPE:    "Esc",
+	sdl.K_F1:        "F1",
+	sdl.K_F2:        "F2",
+	sdl.K_F3:        "F3",
+	sdl.K_F4:        "F4",
+	sdl.K_F5:        "F5",
+	sdl.K_F6:        "F6",
+	sdl.K_F7:        "F7",
+	sdl.K_F8:        "F8",
+	sdl.K_F9:        "F9",
+	sdl.K_F10:       "F10",
+	sdl.K_F11:       "F11",
+	sdl.K_F12:       "F12",
+	sdl.K_HOME:      "Home",
+	sdl.K_INSERT:    "Insert",
+	sdl.K_LEFT:      "Left",
+	sdl.K_PAGEDOWN:  "PgDn",
+	sdl.K_PAGEUP:    "PgUp",
+	sdl.K_RETURN:    "Enter",
+	sdl.K_RIGHT:     "Right",
+	sdl.K_SPACE:     "Space",
+	sdl.K_TAB:       "Tab",
+	sdl.K_UP:        "Up",
+}
+
+// keyName returns the name of the given keycode, or an empty string if the
+// key has no name (e.g. modifier keys).
+func keyName(sym sdl.Keycode) string {
+	if name, ok := keyNames[sym]; ok {
+		return name
+	}
+	if sym > ' ' && sym < 0x7f {
+		return strings.ToUpper(string(rune(sym)))
+	}
+	return ""
+}
+
+// keySpec returns the string representation of a key press, or an empty
+// string if the key has no name. Only the left Alt key counts as Alt, since
+// the right one is AltGr on many layouts and types characters.
+func keySpec(keysym sdl.Keysym) string {
+	name := keyName(keysym.Sym)
+	if name == "" {
+		return ""
+	}
+	if keysym.Mod&sdl.KMOD_SHIFT != 0 {
+		name = "Shift+" + name
+	}
+	if keysym.Mod&sdl.KMOD_LALT != 0 {
+		name = "Alt+" + name
+	}
+	if keysym.Mod&sdl.KMOD_CTRL != 0 {
+		name = "Ctrl+" + name
+	}
+	return name
+}
+
+// normalizeKey returns the canonical form of a single key, as produced by
+// keySpec, or an error if the key is invalid.
+func normalizeKey(key string) (string, error) {
+	// the last token is the key name; allow "+" as a key name
+	tokens := strings.Split(key, "+")
+	name := tokens[len(tokens)-1]
+	mods := tokens[:len(tokens)-1]
+	if name == "" && len(tokens) > 1 && tokens[len(tokens)-2] == "" {
+		name, mods = "+", tokens[:len(tokens)-2]
+	}
+
+	var ctrl, alt, shift bool
+	for _, mod := range mods {
+		switch strings.ToLower(mod) {
+		case "ctrl":
+			ctrl = true
+		case "alt":
+			alt = true
+		case "shift":
+			shift = true
+		default:
+			return "", fmt.Errorf("Unknown modifier: %s", mod)
+		}
+	}
+
+	valid := false
+	if len([]rune(name)) == 1 {
+		name, valid = strings.ToUpper(name), name > " " && name < "\x7f"
+	} else {
+		for _, v := range keyNames {
+			if strings.EqualFold(v, name) {
+				name, valid = v, true
+				break
+			}
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("Unknown key: %s", key)
+	}
+
+	if shift {
+		name = "Shift+" + name
+	}
+	if alt {
+		name = "Alt+" + name
+	}
+	if ctrl {
+		name = "Ctrl+" + name
+	}
+	return name, nil
+}
+
+// parseKeySym converts the string representation of a single key press into
+// a keysym.
+func parseKeySym(spec string) (sdl.Keysym, error) {
+	var keysym sdl.Keysym
+	spec, err := normalizeKey(spec)
+	if err != nil {
+		return keysym, err
+	}
+	tokens := strings.Split(spec, "+")
+	name := tokens[len(tokens)-1]
+	if name == "" {
+		name, tokens = "+", tokens[:len(tokens)-1]
+	}
+	for _, mod := range tokens[:len(tokens)-1] {
+		switch mod {
+		case "Ctrl":
+			keysym.Mod |= sdl.KMOD_LCTRL
+		case "Alt":
+			keysym.Mod |= sdl.KMOD_LALT
+		case "Shift":
+			keysym.Mod |= sdl.KMOD_LSHIFT
+		}
+	}
+	for sym, v := range keyNames {
+		if v == name {
+			keysym.Sym = sym
+			return keysym, nil
+		}
+	}
+	keysym.Sym = sdl.Keycode([]rune(strings.ToLower(name))[0])
+	return keysym, nil
+}
+
+// normalizeKeys returns the canonical form of a key sequence.
+func normalizeKeys(keys string) (string, error) {
+	fields := strings.Fields(keys)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Empty key sequence")
+	}
+	for i, field := range fields {
+		key, err := normalizeKey(field)
+		if err != nil {
+			return "", err
+		}
+		fields[i] = key
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// bindKeys adds or replaces key bindings using a map of key sequences to
+// command names, such as the [keys] section of the .ini file. An empty command
+// name removes a binding. Bad entries are skipped, and the returned error lists
+// all of them.
+func bindKeys(m map[string]string) error {
+	var errs []string
+	for keys, name := range m {
+		keys, err := normalizeKeys(keys)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			delete(bindings, keys)
+		} else if _, ok := commands[name]; ok {
+			bindings[keys] = name
+		} else {
+			errs = append(errs, "Unknown command: "+name)
+		}
+	}
+	if errs != nil {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// isKeyPrefix returns true if keys is the beginning of a bound key sequence.
+func isKeyPrefix(keys string) bool {
+	for k := range bindings {
+		if strings.HasPrefix(k, keys+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupKey processes a key press and returns the name of the command bound
+// to it, if any. If the Shift key was held and only the unshifted key is
+// bound, shift is true. If the key press begins or continues a multi-key
+// sequence, the sequence is stored in rc.Chord and ok is false.
+func (rc *RenderContext) lookupKey(keysym sdl.Keysym) (name string, shift,
+	ok bool) {
+	spec := keySpec(keysym)
+	if spec == "" {
+		return "", false, false // lone modifier key
+	}
+	keys := strings.TrimSpace(rc.Chord + " " + spec)
+	inChord := rc.Chord != ""
+	rc.Chord, rc.EatText = "", false
+
+	if name, ok := bindings[keys]; ok {
+		// Alt+key may also produce text input
+		rc.EatText = inChord || keysym.Mod&sdl.KMOD_LALT != 0
+		return name, false, true
+	}
+	if keysym.Mod&sdl.KMOD_SHIFT != 0 {
+		unshifted := strings.Replace(spec, "Shift+", "", 1)
+		unshifted = strings.TrimSpace(strings.TrimSuffix(keys, spec) +
+			unshifted)
+		if name, ok := bindings[unshifted]; ok {
+			rc.EatText = inChord || keysym.Mod&sdl.KMOD_LALT != 0
+			return name, true, true
+		}
+	}
+	if isKeyPrefix(keys) {
+		rc.Chord, rc.EatText = keys, true
+		if rc.Focus == rc.Pane.Buffer {
+			rc.Status = keys + " ..."
+		}
+	} else if inChord {
+		rc.EatText = true
+		if rc.Focus == rc.Pane.Buffer {
+			rc.Status = fmt.Sprintf("%s is not bound.", keys)
+		}
+	}
+	return "", false, false
+}
+
+// keyOrder returns a sort key for a key sequence, so that keys are grouped by
+// name, unmodified keys come first, and character keys precede named keys.
+func keyOrder(keys string) string {
+	var order []string
+	for _, key := range strings.Fields(keys) {
+		tokens := strings.Split(key, "+")
+		name := tokens[len(tokens)-1]
+		if name == "" {
+			name = "+"
+		}
+		mods := 0
+		for _, mod := range tokens[:len(tokens)-1] {
+			switch mod {
+			case "Ctrl":
+				mods |= 1
+			case "Alt":
+				mods |= 2
+			case "Shift":
+				mods |= 4
+			}
+		}
+		group := "1"
+		if len([]rune(name)) == 1 {
+			group = "0"
+		}
+		order = append(order, fmt.Sprintf("%s%s\x00%d", group, name, mods))
+	}
+	return strings.Join(order, " ")
+}
+
+// sortedBindings returns the bound key sequences in a readable order.
+func sortedBindings() []string {
+	keys := make([]string, 0, len(bindings))
+	for k := range bindings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keyOrder(keys[i]) < keyOrder(keys[j])
+	})
+	return keys
+}
+
+// keysFor returns the key sequences bound to the named commands, in the order
+// of the names and then in readable order.
+func keysFor(names ...string) []string {
+	var keys []string
+	sorted := sortedBindings()
+	for _, name := range names {
+		for _, k := range sorted {
+			if bindings[k] == name {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// printBindings writes a table of key bindings and command descriptions.
+func printBindings(w io.Writer) {
+	for _, keys := range sortedBindings() {
+		fmt.Fprintf(w, "\t%-16s %s\n", keys, commands[bindings[keys]].desc)
+	}
+}
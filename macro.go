@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxMacroDepth  = 16    // limits how deeply macros can play other macros
+	maxMacroEvents = 20000 // limits how many events one playback processes
+)
+
+// macros maps register names to recorded events. Each event is either a key
+// sequence as produced by keySpec, or a quoted string of text input.
+var macros = make(map[string][]string)
+
+// macroPath returns the path of the file that macros are saved to.
+func macroPath() string {
+	return filepath.Join(configDir(), "macros")
+}
+
+// parseMacroLine parses a line of the macro file into a register name and a
+// list of events.
+func parseMacroLine(line string) (string, []string, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	name, rest := fields[0], ""
+	if len(fields) == 2 {
+		rest = fields[1]
+	}
+	var events []string
+	for rest = strings.TrimSpace(rest); rest != ""; rest =
+		strings.TrimSpace(rest) {
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return "", nil, err
+			}
+			events = append(events, quoted)
+			rest = rest[len(quoted):]
+		} else {
+			tokens := strings.SplitN(rest, " ", 2)
+			events = append(events, tokens[0])
+			rest = ""
+			if len(tokens) == 2 {
+				rest = tokens[1]
+			}
+		}
+	}
+	return name, events, nil
+}
+
+// readMacros reads saved macros into a map.
+func readMacros() (map[string][]string, error) {
+	m := make(map[string][]string)
+	contents, err := ioutil.ReadFile(macroPath())
+	if err != nil {
+		return m, err
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, events, err := parseMacroLine(line)
+		if err != nil {
+			return m, err
+		}
+		m[name] = events
+	}
+	return m, nil
+}
+
+// loadMacros loads saved macros, if there are any.
+func loadMacros() error {
+	m, err := readMacros()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for name, events := range m {
+		macros[name] = events
+	}
+	return nil
+}
+
+// saveMacro adds a macro to the macro file, keeping macros saved by other
+// instances.
+func saveMacro(name string, events []string) error {
+	m, err := readMacros()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m[name] = events
+
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, k := range names {
+		line := strings.Join(append([]string{k}, m[k]...), " ")
+		lines = append(lines, line)
+	}
+
+	if err := os.MkdirAll(configDir(), 0755); err != nil {
+		return err
+	}
+	return writeFileSafely(macroPath(),
+		[]byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// recordMacro starts recording a macro, or stops recording and saves the
+// macro if one is already being recorded.
+func recordMacro(rc *RenderContext, shift bool) bool {
+	if rc.MacroName == "" {
+		if rc.Focus != rc.Input {
+			rc.Prompt(recordMacroPrompt)
+		}
+		return true
+	}
+	name, events := rc.MacroName, rc.MacroEvents
+	rc.MacroName, rc.MacroEvents = "", nil
+	macros[name] = events
+	rc.LastMacro = name
+	if err := saveMacro(name, events); err != nil {
+		rc.Status = err.Error()
+	} else if rc.Focus != rc.Input {
+		rc.Status = fmt.Sprintf(`Recorded macro "%s".`, name)
+	}
+	return true
+}
+
+// playMacro prompts for a macro to play.
+func playMacro(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(playMacroPrompt)
+	}
+	return true
+}
+
+// startMacro begins recording a macro into the named register.
+func (rc *RenderContext) startMacro(name string) {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		rc.Status = "Macro names must be non-empty and contain no spaces."
+		return
+	}
+	rc.MacroName, rc.MacroEvents = name, nil
+	rc.Status = fmt.Sprintf(`Recording macro "%s".`, name)
+}
+
+// playMacro plays the macro given by input, which is a register name
+// optionally preceded by a repeat count. Events are processed as if they were
+// typed, and the whole playback, including any macros it plays, is a single
+// undoable action in each pane it edits. Playback stops if it errors or runs
+// out of events. Returns false if the application should quit.
+func (rc *RenderContext) playMacro(input string) bool {
+	count, name := 1, rc.LastMacro
+	fields := strings.Fields(input)
+	if len(fields) > 0 {
+		if n, err := strconv.Atoi(fields[0]); err == nil && len(fields) > 1 {
+			count, fields = n, fields[1:]
+		}
+		name = fields[0]
+	}
+	events, ok := macros[name]
+	if !ok {
+		rc.stopMacro(fmt.Sprintf(`No macro "%s".`, name))
+		return true
+	}
+	if rc.MacroDepth >= maxMacroDepth {
+		rc.stopMacro("Macros nested too deeply.")
+		return true
+	}
+	rc.LastMacro = name
+
+	// the prompt must be closed before playback starts
+	rc.Status = rc.Pane.Title
+	rc.Focus = rc.Pane.Buffer
+
+	if rc.MacroDepth == 0 {
+		rc.MacroBudget = maxMacroEvents
+		rc.MacroPanes = make(map[*Pane]bool)
+		defer rc.endMacroGroups()
+	}
+	rc.MacroDepth++
+	defer func() { rc.MacroDepth-- }()
+	for i := 0; i < count; i++ {
+		for _, event := range events {
+			if rc.MacroBudget < 0 {
+				return true // stopped by a nested macro
+			} else if rc.MacroBudget == 0 {
+				rc.stopMacro("Macro stopped after too many events.")
+				return true
+			}
+			rc.MacroBudget--
+			if !rc.MacroPanes[rc.Pane] {
+				rc.Pane.Separate()
+				rc.Pane.Group++
+				rc.MacroPanes[rc.Pane] = true
+			}
+			prevPane, prevIns := rc.Pane, rc.Pane.IndexFromMark(insMark)
+			if strings.HasPrefix(event, `"`) {
+				text, err := strconv.Unquote(event)
+				if err != nil {
+					rc.stopMacro(err.Error())
+					return true
+				}
+				rc.textEvent(text)
+			} else {
+				keysym, err := parseKeySym(event)
+				if err != nil {
+					rc.stopMacro(err.Error())
+					return true
+				}
+				if _, ok := rc.keyDown(keysym); !ok {
+					return false
+				}
+			}
+			rc.deleteBlankLine(prevPane, prevIns)
+		}
+	}
+	return true
+}
+
+// stopMacro sets the status line to msg and stops the macro playback in
+// progress, if any, including the macros that are playing this one.
+func (rc *RenderContext) stopMacro(msg string) {
+	rc.Status = msg
+	rc.MacroBudget = -1
+}
+
+// endMacroGroups ends the undo groups started by a macro playback in the
+// panes it edited.
+func (rc *RenderContext) endMacroGroups() {
+	for p := range rc.MacroPanes {
+		p.Group--
+		p.Separate()
+		if p.Regions != nil {
+			// edits may have been made anywhere in the buffer
+			p.Regions.reset(p.Buffer)
+		}
+	}
+	rc.MacroPanes = nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -20,19 +22,45 @@ import (
 const version = "0.3.0"
 
 const (
-	insMark = iota // ID of the cursor/insertion mark
-	selMark        // ID of the selection anchor mark
+	insMark        = iota // ID of the cursor/insertion mark
+	selMark               // ID of the selection anchor mark
+	pipeMark              // ID of the mark where pipe output is inserted
+	rangeStartMark        // ID of the mark at the start of the range to search
+	rangeEndMark          // ID of the mark at the end of the range to search
 )
 
 var (
-	darkFlag      = false
-	expandtabFlag = false
-	fontFlag      = ""
-	ptsizeFlag    = 12
-	tabstopFlag   = 8
-	versionFlag   = false
+	darkFlag        = false
+	expandtabFlag   = false
+	filterFlag      = false
+	fontFlag        = ""
+	ignorecaseFlag  = false
+	inselectionFlag = false
+	keysFlag        = false
+	literalFlag     = false
+	ptsizeFlag      = 12
+	remoteFlag      = false
+	tabstopFlag     = 8
+	themeFlag       = ""
+	timeoutFlag     = 0
+	transportFlag   = "ssh"
+	versionFlag     = false
+	wholewordFlag   = false
+	wrapsearchFlag  = true
 )
 
+// cmdLineFlags is the set of flags that only make sense on the command line,
+// and so are not passed to new instances or set at runtime.
+var cmdLineFlags = map[string]bool{
+	"filter":  true,
+	"keys":    true,
+	"remote":  true,
+	"version": true,
+}
+
+// stdinTitle is the title of the buffer in filter mode.
+const stdinTitle = "-"
+
 var sectionFlags = make(map[string]map[string]string)
 var shebangRegexp = regexp.MustCompile(`^#!(/usr/bin/env |/.+/)(.+)( |$)`)
 
@@ -76,47 +104,74 @@ func readIni() {
 	}
 }
 
-// setFileFlags sets flags based on INI settings, the current file path, and
-// the first line of the buffer, and returns syntax rules to be used for the
-// file.
-func setFileFlags(path, line string) []edit.Rule {
+// configDir returns the directory in which configuration files other than the
+// .ini file are stored.
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "fervor")
+	}
+	if curUser, err := user.Current(); err == nil {
+		return filepath.Join(curUser.HomeDir, ".config", "fervor")
+	}
+	return ""
+}
+
+// dataDir returns the directory in which data files, such as logs, are stored.
+func dataDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "fervor")
+	}
+	if curUser, err := user.Current(); err == nil {
+		return filepath.Join(curUser.HomeDir, ".local", "share", "fervor")
+	}
+	return ""
+}
+
+// fileSection returns the name of the INI section that applies to a file,
+// based on the file path and the first line of the buffer, or an empty string
+// if no section applies.
+func fileSection(path, line string) string {
 	fn := filepath.Base(path)
 	var sb string
 	if subs := shebangRegexp.FindStringSubmatch(line); subs != nil {
 		sb = subs[2]
 	}
 
-	// first, reset flags to defaults
-	for k, v := range sectionFlags[""] {
-		flag.Set(k, v) // ignore errors
-	}
-
 	for section, flags := range sectionFlags {
-		match := false
 		if globs, ok := flags["filename"]; ok {
 			for _, glob := range strings.Split(globs, ";") {
-				if match, _ = filepath.Match(glob, fn); match {
-					break
+				if match, _ := filepath.Match(glob, fn); match {
+					return section
 				}
 			}
 		}
-		if shebangs, ok := flags["shebang"]; ok && !match && sb != "" {
+		if shebangs, ok := flags["shebang"]; ok && sb != "" {
 			for _, shebang := range strings.Split(shebangs, ";") {
 				if shebang == sb {
-					match = true
-					break
+					return section
 				}
 			}
 		}
-		if match {
-			for k, v := range flags {
-				flag.Set(k, v) // ignore errors
-			}
-			clampFlags()
-			if syntaxFunc, ok := syntaxMap[section]; ok {
-				return syntaxFunc()
-			}
-			break
+	}
+	return ""
+}
+
+// setFileFlags sets flags based on INI settings, the current file path, and
+// the first line of the buffer, and returns syntax rules to be used for the
+// file.
+func setFileFlags(path, line string) []edit.Rule {
+	// first, reset flags to defaults
+	for k, v := range sectionFlags[""] {
+		flag.Set(k, v) // ignore errors
+	}
+
+	if section := fileSection(path, line); section != "" {
+		for k, v := range sectionFlags[section] {
+			flag.Set(k, v) // ignore errors
+		}
+		clampFlags()
+		if syntaxFunc, ok := syntaxMap[section]; ok {
+			return syntaxFunc()
 		}
 	}
 
@@ -131,6 +186,9 @@ func clampFlags() {
 	if tabstopFlag < 1 {
 		tabstopFlag = 1
 	}
+	if timeoutFlag < 0 {
+		timeoutFlag = 0
+	}
 }
 
 // initFlags initializes the flag package.
@@ -138,22 +196,47 @@ func initFlags() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [<option> ...] [<file> ...]\n",
 			os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -remote <command> [<arg> ...]\n",
+			os.Args[0])
 		fmt.Fprintln(os.Stderr, "\nOptions:")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, `
 Global and file-specific default options can be specified in either
-~/fervor.ini or ~/.config/fervor.ini.`)
+~/fervor.ini or ~/.config/fervor.ini. Key bindings can be changed in the
+[keys] section of the same file.`)
 	}
 	flag.BoolVar(&darkFlag, "dark", darkFlag, "use dark color scheme")
 	flag.BoolVar(&expandtabFlag, "expandtab", expandtabFlag,
 		"insert spaces using the Tab key")
+	flag.BoolVar(&filterFlag, "filter", filterFlag,
+		"edit standard input and write the result to standard output")
 	flag.StringVar(&fontFlag, "font", fontFlag,
 		"use the font at the given path")
+	flag.BoolVar(&ignorecaseFlag, "ignorecase", ignorecaseFlag,
+		"ignore case when searching")
+	flag.BoolVar(&inselectionFlag, "inselection", inselectionFlag,
+		"search only within the selection made before searching")
+	flag.BoolVar(&keysFlag, "keys", keysFlag,
+		"print key bindings and exit")
+	flag.BoolVar(&literalFlag, "literal", literalFlag,
+		"search for literal text instead of regexps")
 	flag.IntVar(&ptsizeFlag, "ptsize", ptsizeFlag, "set point size of font")
+	flag.BoolVar(&remoteFlag, "remote", remoteFlag,
+		"control running instances; run with no arguments for usage")
 	flag.IntVar(&tabstopFlag, "tabstop", tabstopFlag,
 		"set width of tab stops, in columns")
+	flag.StringVar(&themeFlag, "theme", themeFlag,
+		"use the named color theme (default light, or dark with -dark)")
+	flag.IntVar(&timeoutFlag, "timeout", timeoutFlag,
+		"kill commands run from prompts after the given number of seconds")
+	flag.StringVar(&transportFlag, "transport", transportFlag,
+		"run remote commands for ssh:// paths using the given command")
 	flag.BoolVar(&versionFlag, "version", versionFlag,
 		"print version information and exit")
+	flag.BoolVar(&wholewordFlag, "wholeword", wholewordFlag,
+		"search only for whole words")
+	flag.BoolVar(&wrapsearchFlag, "wrapsearch", wrapsearchFlag,
+		"continue searches from the other end of the buffer")
 }
 
 // parseFlags processes command-line flags.
@@ -166,24 +249,53 @@ func parseFlags() {
 			runtime.GOARCH)
 		os.Exit(0)
 	}
+	if keysFlag {
+		printBindings(os.Stdout)
+		os.Exit(0)
+	}
 
 	sectionFlags[""] = map[string]string{
-		"dark":      fmt.Sprintf("%v", darkFlag),
-		"expandtab": fmt.Sprintf("%v", expandtabFlag),
-		"font":      fmt.Sprintf("%v", fontFlag),
-		"ptsize":    fmt.Sprintf("%v", ptsizeFlag),
-		"tabstop":   fmt.Sprintf("%v", tabstopFlag),
+		"dark":        fmt.Sprintf("%v", darkFlag),
+		"expandtab":   fmt.Sprintf("%v", expandtabFlag),
+		"font":        fmt.Sprintf("%v", fontFlag),
+		"ignorecase":  fmt.Sprintf("%v", ignorecaseFlag),
+		"inselection": fmt.Sprintf("%v", inselectionFlag),
+		"literal":     fmt.Sprintf("%v", literalFlag),
+		"ptsize":      fmt.Sprintf("%v", ptsizeFlag),
+		"tabstop":     fmt.Sprintf("%v", tabstopFlag),
+		"theme":       fmt.Sprintf("%v", themeFlag),
+		"timeout":     fmt.Sprintf("%v", timeoutFlag),
+		"transport":   fmt.Sprintf("%v", transportFlag),
+		"wholeword":   fmt.Sprintf("%v", wholewordFlag),
+		"wrapsearch":  fmt.Sprintf("%v", wrapsearchFlag),
 	}
 }
 
-// openFile attempts to open the file given by path and return a new buffer
-// containing the contents of that file. If an error is encountered, it returns
-// a nil buffer and the error instead.
+// openFile attempts to open the file given by path, which may be remote, and
+// return a new buffer containing the contents of that file. If an error is
+// encountered, it returns a nil buffer and the error instead.
 func openFile(path string) (*edit.Buffer, error) {
-	contents, err := ioutil.ReadFile(path)
+	contents, err := readFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return newFileBuffer(path, contents), nil
+}
+
+// readStdin returns a new buffer containing the contents of standard input,
+// and whether they ended with a newline.
+func readStdin() (*edit.Buffer, bool, error) {
+	contents, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, false, err
+	}
+	newline := bytes.HasSuffix(contents, []byte("\n"))
+	return newFileBuffer("", contents), newline, nil
+}
+
+// newFileBuffer returns a new buffer containing contents, with syntax rules
+// and flags set based on path.
+func newFileBuffer(path string, contents []byte) *edit.Buffer {
 	buf := edit.NewBuffer()
 	buf.Insert(buf.End(), string(contents))
 	if buf.Get(buf.ShiftIndex(buf.End(), -1), buf.End()) == "\n" {
@@ -194,7 +306,7 @@ func openFile(path string) (*edit.Buffer, error) {
 	syntaxRules := setFileFlags(path,
 		buf.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30}))
 	buf.SetSyntax(syntaxRules)
-	return buf, nil
+	return buf
 }
 
 // lineEnding returns the line ending string used for a buffer, and converts
@@ -210,11 +322,32 @@ func lineEnding(b *edit.Buffer) string {
 }
 
 func main() {
+	os.Exit(start())
+}
+
+// start runs the application and returns its exit status.
+func start() int {
 	log.SetFlags(log.Lshortfile)
 	initFlags()
 	readIni()
+	if err := bindKeys(sectionFlags["[keys]"]); err != nil {
+		log.Print(err)
+	}
 	parseFlags()
-	setColorScheme()
+	if remoteFlag {
+		return remoteMain(flag.Args())
+	}
+	if filterFlag && flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: -filter takes no file arguments\n",
+			os.Args[0])
+		return 1
+	}
+	if err := setColorScheme(); err != nil {
+		log.Print(err)
+	}
+	if err := loadMacros(); err != nil {
+		log.Print(err)
+	}
 
 	// init SDL
 	runtime.LockOSThread()
@@ -226,39 +359,73 @@ func main() {
 	defer ttf.Quit()
 
 	// open new instances for other file args
-	if flag.NArg() > 1 {
-		for _, arg := range flag.Args()[1:] {
-			newInstance(arg, "")
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	for _, arg := range args {
+		newInstance(arg, "")
+	}
+	if !filterFlag && flag.Arg(0) != "" {
+		if c := raiseRemote(flag.Arg(0)); c != nil {
+			c.close()
+			return 0
 		}
 	}
 
 	// init buffer
 	var arg, status string
-	if flag.NArg() == 0 || flag.Arg(0) == "" {
+	if filterFlag {
+		arg = stdinTitle
+	} else if flag.NArg() == 0 || flag.Arg(0) == "" {
 		arg = os.DevNull
 	} else {
 		arg = flag.Arg(0)
 	}
 	var buf *edit.Buffer
+	var newline bool // whether standard input ended with a newline
 	var err error
-	if buf, err = openFile(arg); err == nil {
+	if filterFlag {
+		if buf, newline, err = readStdin(); err != nil {
+			log.Print(err)
+			return 1
+		}
+		status = "Read standard input."
+	} else if buf, err = openFile(arg); err == nil {
 		status = fmt.Sprintf(`Opened "%s".`, minPath(arg))
 	} else {
 		status = fmt.Sprintf(`New file: "%s".`, minPath(arg))
 		buf = edit.NewBuffer()
 		buf.SetSyntax(setFileFlags(arg, ""))
 	}
-	pane := &Pane{buf, minPath(arg), tabstopFlag, 80, 25, lineEnding(buf)}
+	pane := &Pane{Buffer: buf, Title: minPath(arg), TabWidth: tabstopFlag,
+		Cols: 80, Rows: 25, LineEnding: lineEnding(buf)}
 	if pane.LineEnding == "\r\n" {
 		status += " [DOS]"
 	}
 	pane.SetTabWidth(tabstopFlag)
 	pane.Mark(edit.Index{1, 0}, selMark, insMark)
+	pane.Regions = newHighlighter(buf, fileRegions(arg,
+		buf.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30})))
 	font := getFont()
 	win := createWindow(minPath(arg), font)
 	defer win.Destroy()
 	w, h := win.GetSize()
 	resize(pane, w, h)
 
-	eventLoop(pane, status, font, win)
+	ok := eventLoop(pane, status, font, win)
+	if filterFlag {
+		if !ok {
+			return 1
+		}
+		text := paneText(pane)
+		if !newline {
+			text = strings.TrimSuffix(text, pane.LineEnding)
+		}
+		if _, err := io.WriteString(os.Stdout, text); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	return 0
 }
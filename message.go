@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Goroutines pass data to the event loop by sending a message on the messages
+// channel. Since the event loop waits on the SDL event queue rather than the
+// channel, the sender also pushes a wakeup event, which carries no data. At
+// most one wakeup event is pending at a time.
+
+// message is a value passed to the event loop. It is a statusMessage,
+// *pipeOutput, *termOutput, *jobExit, *matchCount, *grepResult, *preview,
+// *remoteRequest, or *historySave.
+type message interface{}
+
+// statusMessage is a message to show in the status line.
+type statusMessage string
+
+var messages = make(chan message, 256)
+
+var (
+	wakeupEventType uint32 // set at beginning of event loop
+	wakeupPending   int32  // 1 if a wakeup event is in the queue
+)
+
+// postMessage passes msg to the event loop. It blocks if the channel is full.
+func postMessage(msg message) {
+	messages <- msg
+	if atomic.CompareAndSwapInt32(&wakeupPending, 0, 1) {
+		sdl.PushEvent(&sdl.UserEvent{Type: wakeupEventType})
+	}
+}
+
+// receiveMessages handles the messages waiting in the channel. Messages sent
+// while it runs are left for the next wakeup event, so that a flood of output
+// can't keep the display from updating.
+func (rc *RenderContext) receiveMessages() {
+	atomic.StoreInt32(&wakeupPending, 0)
+	for n := len(messages); n > 0; n-- {
+		switch msg := (<-messages).(type) {
+		case statusMessage:
+			if rc.Focus != rc.Input {
+				rc.Status = string(msg)
+			}
+		case *pipeOutput:
+			rc.pipeEvent(msg)
+		case *termOutput:
+			rc.termEvent(msg)
+		case *jobExit:
+			rc.jobExited(msg)
+		case *matchCount:
+			rc.matchCounted(msg)
+		case *grepResult:
+			rc.grepDone(msg)
+		case *preview:
+			rc.previewDone(msg)
+		case *remoteRequest:
+			rc.remoteEvent(msg)
+		case *historySave:
+			rc.historySaved(msg)
+		}
+	}
+}
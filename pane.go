@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jangler/edit"
+)
+
+// paneKind identifies scratch panes in which some commands act differently.
+type paneKind int
+
+const (
+	plainPane   paneKind = iota
+	grepPane             // Enter opens the hit under the cursor
+	previewPane          // deleting drops hunks, and saving writes files
+)
+
+// kindCommands maps kinds of panes to the edit commands that have a special
+// meaning in them, and so are not disabled in read-only panes.
+var kindCommands = map[paneKind]map[string]bool{
+	grepPane:    {"enter": true},
+	previewPane: {"delete-backward": true, "delete-forward": true},
+}
+
+// newScratchPane returns a new read-only pane containing text that is not
+// associated with a file.
+func newScratchPane(title, text string) *Pane {
+	buf := edit.NewBuffer()
+	buf.Insert(edit.Index{1, 0}, text)
+	buf.ResetModified()
+	buf.ResetUndo()
+	p := &Pane{Buffer: buf, Title: title, TabWidth: 8, Cols: 80, Rows: 25,
+		LineEnding: "\n", ReadOnly: true, Scratch: true}
+	p.SetTabWidth(p.TabWidth)
+	p.Mark(edit.Index{1, 0}, selMark, insMark)
+	return p
+}
+
+// findPane returns the open pane with the given title, or nil if there is no
+// such pane.
+func (rc *RenderContext) findPane(title string) *Pane {
+	for _, p := range rc.Panes {
+		if p.Title == title {
+			return p
+		}
+	}
+	return nil
+}
+
+// showPane displays p in the window, adding it to the list of open panes if
+// it is not already open.
+func (rc *RenderContext) showPane(p *Pane) {
+	found := false
+	for _, q := range rc.Panes {
+		found = found || q == p
+	}
+	if !found {
+		rc.Panes = append(rc.Panes, p)
+	}
+	rc.Pane = p
+	rc.Focus = p.Buffer
+	rc.Status = p.Title
+	rc.Window.SetTitle(p.Title)
+	w, h := rc.Window.GetSize()
+	resize(p, w, h)
+	if !p.Scratch {
+		rc.UpdateFlags()
+	}
+	p.SetTabWidth(p.TabWidth)
+}
+
+// isStdinPane returns true if p holds standard input in filter mode, which is
+// written to standard output on quit and so must not be replaced.
+func isStdinPane(p *Pane) bool {
+	return filterFlag && p.Title == stdinTitle
+}
+
+// openNew displays the file at path if a pane has it open, and otherwise opens
+// it in a new instance.
+func (rc *RenderContext) openNew(path string) {
+	if panes := rc.filePanes(absPath(path)); panes != nil {
+		rc.showPane(panes[0])
+		return
+	}
+
+	// asking other instances whether they have the file open can take a
+	// while, so don't wait for them
+	rc.Status = fmt.Sprintf(`Opening "%s" in a new window.`, minPath(path))
+	go func() {
+		if status := newInstance(path, ""); status != "" {
+			postMessage(statusMessage(status))
+		}
+	}()
+}
+
+// visitFile displays the file at path in the first pane, opening it there if
+// it isn't open already. It returns false and sets the status line if another
+// file with unsaved changes, or standard input, is open.
+func (rc *RenderContext) visitFile(path string) bool {
+	p := rc.Panes[0]
+	if minPath(path) != minPath(p.Title) {
+		if isStdinPane(p) {
+			rc.Status = "Standard input can't be replaced."
+			return false
+		}
+		if p.Modified() {
+			rc.Status = fmt.Sprintf(`"%s" has unsaved changes.`, p.Title)
+			return false
+		}
+	}
+	rc.openInFirstPane(path)
+	return true
+}
+
+// confirmVisit displays the file at path in the first pane like visitFile and
+// then calls then. If another file with unsaved changes is open there, the
+// user is first asked whether to discard the changes. If standard input is
+// open there, the file is opened in a new instance instead.
+func (rc *RenderContext) confirmVisit(path string, then func()) {
+	visit := func() {
+		rc.openInFirstPane(path)
+		then()
+	}
+	if p := rc.Panes[0]; minPath(path) != minPath(p.Title) {
+		if isStdinPane(p) {
+			rc.openNew(path)
+			return
+		}
+		if p.Modified() {
+			rc.Visit = visit
+			rc.Prompt(reallyVisitPrompt)
+			return
+		}
+	}
+	visit()
+}
+
+// openInFirstPane displays the file at path in the first pane, replacing any
+// other file open there.
+func (rc *RenderContext) openInFirstPane(path string) {
+	p := rc.Panes[0]
+	rc.showPane(p)
+	if minPath(path) != minPath(p.Title) {
+		rc.loadFile(path)
+	}
+}
+
+// paneID returns the ID by which commands run from p can name it over the
+// socket, giving p one if it has none yet.
+func (rc *RenderContext) paneID(p *Pane) int {
+	if p.ID == 0 {
+		rc.PaneCount++
+		p.ID = rc.PaneCount
+	}
+	return p.ID
+}
+
+// closePane removes the current pane from the list of open panes and displays
+// the most recently opened remaining pane, stopping any process attached to
+// it. The first pane is never closed.
+func (rc *RenderContext) closePane() {
+	if len(rc.Panes) < 2 || rc.Pane == rc.Panes[0] {
+		return
+	}
+	if rc.Pane.Term != nil {
+		rc.Pane.Term.close()
+	}
+	if rc.Pane.Pipe != nil {
+		rc.Pane.Pipe.kill()
+		rc.Pane.Pipe = nil
+	}
+	for i, p := range rc.Panes {
+		if p == rc.Pane {
+			rc.Panes = append(rc.Panes[:i], rc.Panes[i+1:]...)
+			break
+		}
+	}
+	rc.showPane(rc.Panes[len(rc.Panes)-1])
+}
+
+// modified returns true if any open pane has unsaved changes to a file.
+// Standard input in filter mode doesn't count, since it is written on quit.
+func (rc *RenderContext) modified() bool {
+	for _, p := range rc.Panes {
+		if !p.Scratch && !isStdinPane(p) && p.Modified() {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnly returns true and sets the status line if the focused buffer is a
+// read-only pane, or a pane that a command is piping output into.
+func (rc *RenderContext) readOnly() bool {
+	if rc.Focus != rc.Pane.Buffer {
+		return false
+	}
+	if rc.Pane.ReadOnly {
+		rc.Status = "Buffer is read-only."
+		return true
+	}
+	if rc.Pane.Pipe != nil {
+		rc.Status = fmt.Sprintf(`Command "%s" is still running.`,
+			rc.Pane.Pipe.cmdString)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os/exec"
+
+// setProcessGroup does nothing, since process groups are not used on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills a started cmd. Processes it started are not killed.
+func killProcessGroup(cmd *exec.Cmd, force bool) error {
+	return cmd.Process.Kill()
+}
@@ -1,46 +1,100 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/jangler/edit"
 )
 
 const (
-	cdPrompt           = "Change directory to: "
-	findBackwardPrompt = "Find backward: "
-	findForwardPrompt  = "Find forward: "
-	goToLinePrompt     = "Go to line: "
-	openNewPrompt      = "Open in new window: "
-	openPrompt         = "Open: "
-	pipePrompt         = "Pipe selection through: "
-	reallyOpenPrompt   = "Really open (y/n)? "
-	reallyQuitPrompt   = "Really quit (y/n)? "
-	runPrompt          = "Run: "
-	saveAsPrompt       = "Save as: "
+	cdPrompt               = "Change directory to: "
+	findBackwardPrompt     = "Find backward: "
+	findForwardPrompt      = "Find forward: "
+	goToLinePrompt         = "Go to line: "
+	grepPrompt             = "Grep: "
+	jobsPrompt             = "Job action: "
+	openNewPrompt          = "Open in new window: "
+	openPrompt             = "Open: "
+	pipePrompt             = "Pipe selection through: "
+	playMacroPrompt        = "Play macro: "
+	reallyOpenPrompt       = "Really open (y/n)? "
+	reallyQuitPrompt       = "Really quit (y/n)? "
+	reallyQuitJobsPrompt   = "Kill jobs and quit (y/n)? "
+	reallyVisitPrompt      = "Discard unsaved changes (y/n)? "
+	recordMacroPrompt      = "Record macro: "
+	replaceAskPrompt       = "Replace match (y/n/a/q)? "
+	replaceFilesPrompt     = "Replace in files: "
+	replaceFilesWithPrompt = "Replace in files with: "
+	replaceModePrompt      = "Replace where (a/s/i)? "
+	replacePrompt          = "Replace: "
+	replaceWithPrompt      = "With: "
+	runPrompt              = "Run: "
+	saveAsPrompt           = "Save as: "
+	setPrompt              = "Set: "
+	terminalPrompt         = "Terminal: "
 )
 
-// UpdateFlags updates file-dependent flags for the RenderContext.
+// UpdateFlags updates file-dependent flags for the RenderContext. Options set
+// at runtime take precedence over file-dependent flags.
 func (rc *RenderContext) UpdateFlags() {
-	prevFontFlag, prevPtsizeFlag := fontFlag, ptsizeFlag
-	syntaxRules := setFileFlags(rc.Pane.Title,
-		rc.Pane.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30}))
-	if fontFlag != prevFontFlag || ptsizeFlag != prevPtsizeFlag {
+	firstLine := rc.Pane.Get(edit.Index{1, 0}, edit.Index{1, 1 << 30})
+	syntaxRules := setFileFlags(rc.Pane.Title, firstLine)
+	for k, v := range rc.Options {
+		flag.Set(k, v) // already validated
+	}
+	clampFlags()
+	if fontFlag != loadedFont || ptsizeFlag != loadedPtsize {
 		rc.Font = getFont()
+		w, h := rc.Window.GetSize()
+		resize(rc.Pane, w, h)
 	}
-	if darkFlag != (bgColor == darkBgColor) {
-		setColorScheme()
+	if themeName() != currentTheme {
+		if err := setColorScheme(); err != nil {
+			log.Print(err)
+		}
 	}
 	rc.Pane.SetSyntax(syntaxRules)
+	rc.Pane.Regions = newHighlighter(rc.Pane.Buffer,
+		fileRegions(rc.Pane.Title, firstLine))
 	rc.Pane.TabWidth = tabstopFlag
 	rc.Pane.SetTabWidth(tabstopFlag)
 }
 
+// setOption sets an option for the rest of the session, given input of the
+// form name=value. If input is only a name, the option's value is shown.
+func (rc *RenderContext) setOption(input string) {
+	tokens := strings.SplitN(strings.TrimSpace(input), "=", 2)
+	name := strings.TrimSpace(tokens[0])
+	f := flag.Lookup(name)
+	if f == nil || cmdLineFlags[name] {
+		rc.Status = fmt.Sprintf(`No option "%s".`, name)
+		return
+	}
+	if len(tokens) == 2 {
+		prevValue := f.Value.String()
+		if err := flag.Set(name, strings.TrimSpace(tokens[1])); err != nil {
+			rc.Status = fmt.Sprintf(`Invalid value for %s: "%s".`, name,
+				tokens[1])
+			return
+		}
+		clampFlags()
+		rc.Options[name] = f.Value.String()
+		rc.UpdateFlags()
+		if f.Value.String() != prevValue {
+			rc.Status = fmt.Sprintf("Set %s=%s.", name, f.Value)
+			return
+		}
+	}
+	rc.Status = fmt.Sprintf("%s=%s", name, f.Value)
+}
+
 // EnterInput exits prompt mode, taking action based on the prompt string and
 // input text. Returns false if the application should quit.
 func (rc *RenderContext) EnterInput() bool {
@@ -51,28 +105,32 @@ func (rc *RenderContext) EnterInput() bool {
 		if abs, err := filepath.Abs(input); err == nil {
 			input = abs
 		}
-		name := expandVars(rc.Pane.Title)
-		if abs, err := filepath.Abs(name); err == nil {
-			name = abs
+		names := make([]string, len(rc.Panes))
+		for i, p := range rc.Panes {
+			names[i] = expandVars(p.Title)
+			if abs, err := filepath.Abs(names[i]); err == nil &&
+				!isRemote(names[i]) {
+				names[i] = abs
+			}
 		}
 		if err := os.Chdir(input); err == nil {
 			rc.Status = fmt.Sprintf(`Working dir is "%s".`, input)
-			rc.Pane.Title = minPath(name)
+			for i, p := range rc.Panes {
+				if !p.Scratch {
+					p.Title = minPath(names[i])
+				}
+			}
 			rc.Window.SetTitle(rc.Pane.Title)
 		} else {
 			rc.Status = err.Error()
 		}
-	case findBackwardPrompt:
-		if re, err := regexp.Compile(input); err == nil {
-			rc.Regexp = re
-			rc.Status = find(rc.Pane.Buffer, rc.Regexp, false, rc.Status)
-		} else {
-			rc.Status = err.Error()
-		}
-	case findForwardPrompt:
-		if re, err := regexp.Compile(input); err == nil {
-			rc.Regexp = re
-			rc.Status = find(rc.Pane.Buffer, rc.Regexp, true, rc.Status)
+	case findBackwardPrompt, findForwardPrompt:
+		rc.endSearch(false)
+		if re, err := compileSearch(input, literalFlag); err == nil {
+			rc.Pattern = input
+			rc.Status = find(rc.Pane.Buffer, re,
+				rc.Status == findForwardPrompt, rc.Pane.Title)
+			rc.Pane.Separate()
 		} else {
 			rc.Status = err.Error()
 		}
@@ -88,53 +146,106 @@ func (rc *RenderContext) EnterInput() bool {
 			rc.Status = rc.Pane.Title
 			break
 		}
-		rc.Pane.Delete(edit.Index{1, 0}, rc.Pane.End())
-		input = expandVars(input)
-		if contents, err := ioutil.ReadFile(input); err == nil {
-			rc.Pane.Insert(edit.Index{1, 0}, string(contents))
-			penult := rc.Pane.ShiftIndex(rc.Pane.End(), -1)
-			if rc.Pane.Get(penult, rc.Pane.End()) == "\n" {
-				rc.Pane.Delete(penult, rc.Pane.End())
-			}
-			rc.Status = fmt.Sprintf(`Opened "%s".`, minPath(input))
+		if isStdinPane(rc.Pane) {
+			rc.openNew(expandVars(input))
 		} else {
-			rc.Status = fmt.Sprintf(`New file: "%s".`, minPath(input))
-		}
-		rc.Pane.LineEnding = lineEnding(rc.Pane.Buffer)
-		if rc.Pane.LineEnding == "\r\n" {
-			rc.Status += " [DOS]"
+			rc.loadFile(expandVars(input))
 		}
-		rc.Pane.Mark(edit.Index{1, 0}, selMark, insMark)
-		rc.Pane.Title = minPath(input)
-		rc.Window.SetTitle(rc.Pane.Title)
-		rc.Pane.ResetModified()
-		rc.Pane.ResetUndo()
-		rc.UpdateFlags()
 	case openNewPrompt:
-		rc.Status = newInstance(expandVars(input), rc.Pane.Title)
+		rc.openNew(expandVars(input))
 	case pipePrompt:
 		rc.Status = rc.Pane.Title
 		if input == "" {
 			break
 		}
-		rc.Status = pipeCmd(input, getSelection(rc.Pane.Buffer), rc.Status)
+		rc.Status = rc.pipeCmd(input)
+		rc.recordStep(editStep{cmd: "pipe", text: input})
+		rc.EditOpen = false
+	case playMacroPrompt:
+		return rc.playMacro(input)
 	case reallyOpenPrompt:
 		if input == "y" || input == "yes" {
 			rc.Prompt(openPrompt)
 			return true // so that main buffer isn't focused
 		}
 		rc.Status = rc.Pane.Title
-	case reallyQuitPrompt:
+	case reallyQuitPrompt, reallyQuitJobsPrompt:
 		if input == "y" || input == "yes" {
+			if rc.Status == reallyQuitPrompt && rc.runningJobs() {
+				rc.Prompt(reallyQuitJobsPrompt)
+				return true
+			}
 			return false
 		}
 		rc.Status = rc.Pane.Title
+	case reallyVisitPrompt:
+		rc.Status = rc.Pane.Title
+		if input == "y" || input == "yes" {
+			rc.Visit()
+		}
+		rc.Visit = nil
+	case grepPrompt:
+		rc.Status = rc.Pane.Title
+		if input != "" {
+			rc.Status = rc.startGrep(input)
+		}
+	case jobsPrompt:
+		rc.Status = rc.Pane.Title
+		if input != "" {
+			rc.Status = rc.jobCommand(input)
+		}
+	case recordMacroPrompt:
+		rc.startMacro(input)
+	case replacePrompt:
+		rc.Status = rc.Pane.Title
+		if input == "" {
+			break
+		}
+		re, err := regexp.Compile(input)
+		if err != nil {
+			rc.Status = err.Error()
+			break
+		}
+		rc.Replace = &replaceRun{re: re}
+		rc.Prompt(replaceWithPrompt)
+		return true
+	case replaceWithPrompt:
+		rc.Replace.template = input
+		rc.Prompt(replaceModePrompt)
+		return true
+	case replaceFilesPrompt:
+		rc.Status = rc.Pane.Title
+		if input == "" {
+			break
+		}
+		re, err := regexp.Compile(input)
+		if err != nil {
+			rc.Status = err.Error()
+			break
+		}
+		rc.Replace = &replaceRun{re: re}
+		rc.Prompt(replaceFilesWithPrompt)
+		return true
+	case replaceFilesWithPrompt:
+		rc.Status = rc.startPreview(rc.Replace.re, input)
+		rc.Replace = nil
+	case replaceModePrompt:
+		rc.startReplace(input)
+	case replaceAskPrompt:
+		rc.replaceAnswer(input)
+		if rc.Replace != nil {
+			return true // still asking
+		}
 	case runPrompt:
 		rc.Status = rc.Pane.Title
 		if input == "" {
 			break
 		}
-		runCmd(input)
+		rc.Status = rc.runCmd(input)
+	case setPrompt:
+		rc.setOption(input)
+	case terminalPrompt:
+		rc.startTerminal(input)
 	case saveAsPrompt:
 		prevTitle := rc.Pane.Title
 		input = expandVars(input)
@@ -157,11 +268,38 @@ func (rc *RenderContext) EnterInput() bool {
 	return true
 }
 
+// loadFile replaces the contents of the current pane with the file at path,
+// which may be remote, or empties the pane if the file does not exist.
+func (rc *RenderContext) loadFile(path string) {
+	rc.Pane.Delete(edit.Index{1, 0}, rc.Pane.End())
+	if contents, err := readFile(path); err == nil {
+		rc.Pane.Insert(edit.Index{1, 0}, string(contents))
+		penult := rc.Pane.ShiftIndex(rc.Pane.End(), -1)
+		if rc.Pane.Get(penult, rc.Pane.End()) == "\n" {
+			rc.Pane.Delete(penult, rc.Pane.End())
+		}
+		rc.Status = fmt.Sprintf(`Opened "%s".`, minPath(path))
+	} else {
+		rc.Status = fmt.Sprintf(`New file: "%s".`, minPath(path))
+	}
+	rc.Pane.LineEnding = lineEnding(rc.Pane.Buffer)
+	if rc.Pane.LineEnding == "\r\n" {
+		rc.Status += " [DOS]"
+	}
+	rc.Pane.Mark(edit.Index{1, 0}, selMark, insMark)
+	rc.Pane.Title = minPath(path)
+	rc.Window.SetTitle(rc.Pane.Title)
+	rc.Pane.ResetModified()
+	rc.Pane.ResetUndo()
+	rc.UpdateFlags()
+}
+
 // Prompt enters into prompt mode, prompting for input with the given string.
 func (rc *RenderContext) Prompt(s string) {
 	rc.Input.ResetUndo()
 	rc.Pane.Separate()
-	rc.Status = s
+	rc.Status, rc.PromptNote = s, ""
+	rc.HistSearch = nil
 	rc.Focus = rc.Input
 	rc.Input.Delete(edit.Index{1, 0}, rc.Input.End())
 }
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/kr/pty"
+)
+
+// startPty starts cmd with a new pseudo-terminal as its standard input,
+// output, and error, and returns the master side of the terminal.
+func startPty(cmd *exec.Cmd) (*os.File, error) {
+	return pty.Start(cmd)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// startPty returns an error, since pseudo-terminals are not available on
+// Windows.
+func startPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("Terminal buffers are not supported on Windows.")
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Each instance listens on a Unix socket, named after its process ID, in a
+// directory that only the user can access. A client sends requests, one per
+// line, each consisting of a command name optionally followed by a space and
+// an argument. For commands that take text, the argument is a byte count and
+// the line is followed by that many bytes of text. Each request is answered by
+// a line "ok N" followed by N bytes of data, or by a line "error MESSAGE".
+
+// remoteTimeout limits how long a client waits for an instance to reply.
+const remoteTimeout = 5 * time.Second
+
+// remoteSocket is the path of the socket this instance listens on, if any.
+var remoteSocket string
+
+// remoteRequest is a request received on the socket, passed to the event loop.
+type remoteRequest struct {
+	cmd, arg string
+	pane     int // ID of the pane given by the connection's pane command
+	reply    chan remoteReply
+}
+
+// remoteReply is the result of a remote request.
+type remoteReply struct {
+	data string
+	err  error
+}
+
+// remoteCommands maps the names of remote commands to functions that carry
+// them out and return the data to reply with.
+var remoteCommands = map[string]func(*RenderContext, string) (string, error){
+	"addr":      remoteAddr,
+	"goto":      remoteGoTo,
+	"insert":    remoteInsert,
+	"list":      remoteList,
+	"open":      remoteOpen,
+	"pane":      remotePane,
+	"raise":     remoteRaise,
+	"read":      remoteRead,
+	"replace":   remoteReplace,
+	"save":      remoteSave,
+	"select":    remoteSelect,
+	"selection": remoteSelection,
+	"status":    remoteStatus,
+}
+
+// remoteDir returns the directory containing the sockets of running instances,
+// creating it if necessary.
+func remoteDir() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "fervor")
+	} else {
+		name := "fervor"
+		if curUser, err := user.Current(); err == nil {
+			name += "-" + curUser.Uid
+		}
+		dir = filepath.Join(os.TempDir(), name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// only the owner can change the mode, so this fails if another user
+	// created the directory
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// listenRemote starts accepting requests on this instance's socket. The
+// socket is removed when the returned listener is closed.
+func listenRemote() (net.Listener, error) {
+	dir, err := remoteDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	os.Remove(path) // left by an instance that didn't exit cleanly
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	remoteSocket = path
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go serveRemote(conn)
+		}
+	}()
+	return l, nil
+}
+
+// serveRemote answers requests on a connection until it is closed.
+func serveRemote(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	pane := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		req := &remoteRequest{cmd: fields[0], pane: pane,
+			reply: make(chan remoteReply, 1)}
+		if len(fields) == 2 {
+			req.arg = fields[1]
+		}
+		if textCommands[req.cmd] {
+			n, err := strconv.Atoi(req.arg)
+			if err != nil || n < 0 {
+				fmt.Fprintf(conn, "error Bad byte count: %s\n", req.arg)
+				return // the text can't be skipped
+			}
+			text := make([]byte, n)
+			if _, err := io.ReadFull(r, text); err != nil {
+				return
+			}
+			req.arg = string(text)
+		}
+		postMessage(req)
+		if rep := <-req.reply; rep.err != nil {
+			msg := strings.Replace(rep.err.Error(), "\n", " ", -1)
+			_, err = fmt.Fprintf(conn, "error %s\n", msg)
+		} else {
+			if req.cmd == "pane" {
+				pane, _ = strconv.Atoi(req.arg) // checked by remotePane
+			}
+			_, err = fmt.Fprintf(conn, "ok %d\n%s", len(rep.data), rep.data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// remoteEvent carries out a request received on the socket.
+func (rc *RenderContext) remoteEvent(req *remoteRequest) {
+	fn, ok := remoteCommands[req.cmd]
+	if !ok {
+		req.reply <- remoteReply{
+			err: fmt.Errorf("Unknown command: %s", req.cmd)}
+		return
+	}
+	rc.RemotePane = req.pane
+	data, err := fn(rc, req.arg)
+	req.reply <- remoteReply{data, err}
+}
+
+// remoteList replies with the absolute paths of open files, one per line.
+func remoteList(rc *RenderContext, arg string) (string, error) {
+	var paths []string
+	for _, p := range rc.Panes {
+		if !p.Scratch {
+			paths = append(paths, absPath(p.Title)+"\n")
+		}
+	}
+	return strings.Join(paths, ""), nil
+}
+
+// remoteOpen displays the file at the path given by arg, opening it if it
+// isn't open already, and raises the window.
+func remoteOpen(rc *RenderContext, arg string) (string, error) {
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	}
+	if !rc.visitFile(arg) {
+		return "", errors.New(rc.Status)
+	}
+	rc.Window.Raise()
+	return "", nil
+}
+
+// remoteGoTo selects the line of the current file given by arg and raises the
+// window.
+func remoteGoTo(rc *RenderContext, arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", err
+	}
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	}
+	selectLine(rc.Pane.Buffer, n)
+	seeMark(rc.Pane.Buffer, insMark, rc.Pane.Rows)
+	rc.Window.Raise()
+	return "", nil
+}
+
+// remoteRaise displays the file at the absolute path given by arg and raises
+// the window, or fails if the file isn't open.
+func remoteRaise(rc *RenderContext, arg string) (string, error) {
+	panes := rc.filePanes(arg)
+	if panes == nil {
+		return "", fmt.Errorf(`"%s" is not open.`, minPath(arg))
+	}
+	if rc.Focus == rc.Input {
+		rc.cancelPrompt()
+	}
+	rc.showPane(panes[0])
+	rc.Window.Raise()
+	return "", nil
+}
+
+// remoteSave saves all files with unsaved changes and replies with their
+// paths, one per line.
+func remoteSave(rc *RenderContext, arg string) (string, error) {
+	var paths []string
+	for _, p := range rc.Panes {
+		if p.Scratch || !p.Modified() {
+			continue
+		}
+		if err := saveFile(p); err != nil {
+			return strings.Join(paths, ""), fmt.Errorf("%s: %v", p.Title, err)
+		}
+		paths = append(paths, absPath(p.Title)+"\n")
+	}
+	rc.Status = fmt.Sprintf("Saved %d files.", len(paths))
+	return strings.Join(paths, ""), nil
+}
+
+// remoteClient is a connection to the socket of another instance.
+type remoteClient struct {
+	path string // of the socket
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRemote connects to the socket at path.
+func dialRemote(path string) (*remoteClient, error) {
+	conn, err := net.DialTimeout("unix", path, remoteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteClient{path, conn, bufio.NewReader(conn)}, nil
+}
+
+// request sends a request and returns the data in the reply.
+func (c *remoteClient) request(cmd, arg string) (string, error) {
+	if strings.Contains(arg, "\n") {
+		return "", errors.New("Argument contains a newline.")
+	}
+	if arg != "" {
+		cmd += " " + arg
+	}
+	c.conn.SetDeadline(time.Now().Add(remoteTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s\n", cmd); err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasPrefix(line, "error ") {
+		return "", errors.New(strings.TrimPrefix(line, "error "))
+	}
+	var n int
+	if _, err := fmt.Sscanf(line, "ok %d", &n); err != nil {
+		return "", fmt.Errorf("Bad reply: %q", line)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(c.r, data)
+	return string(data), err
+}
+
+// close closes the connection.
+func (c *remoteClient) close() {
+	c.conn.Close()
+}
+
+// isRefused returns true if err is the error from connecting to a socket that
+// no process is listening on.
+func isRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// remoteInstances returns connections to the other running instances, most
+// recently started first. Sockets left by instances that didn't exit cleanly
+// are removed.
+func remoteInstances() []*remoteClient {
+	dir, err := remoteDir()
+	if err != nil {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sock"))
+	times := make(map[string]time.Time)
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			times[path] = fi.ModTime()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return times[paths[i]].After(times[paths[j]])
+	})
+
+	var clients []*remoteClient
+	for _, path := range paths {
+		if path == remoteSocket {
+			continue
+		}
+		if c, err := dialRemote(path); err == nil {
+			clients = append(clients, c)
+		} else if isRefused(err) {
+			os.Remove(path)
+		}
+	}
+	return clients
+}
+
+// instanceName returns the name of the instance a client is connected to,
+// which is its process ID.
+func (c *remoteClient) instanceName() string {
+	return strings.TrimSuffix(filepath.Base(c.path), ".sock")
+}
+
+// raiseRemote raises the window of another instance that has the file at
+// path open, and returns the connection to it, or nil if there is none.
+func raiseRemote(path string) *remoteClient {
+	var found *remoteClient
+	for _, c := range remoteInstances() {
+		if found == nil {
+			if _, err := c.request("raise", absPath(path)); err == nil {
+				found = c
+				continue
+			}
+		}
+		c.close()
+	}
+	return found
+}
+
+// startInstance starts a new instance editing the file at path and returns a
+// connection to it once it is listening.
+func startInstance(path string) (*remoteClient, error) {
+	cmd := exec.Command(os.Args[0], append(flags(), path)...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(remoteTimeout)
+	for time.Now().Before(deadline) {
+		if c := raiseRemote(path); c != nil {
+			return c, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf(`No instance opened "%s".`, path)
+}
+
+// remoteUsage is the usage message for -remote.
+const remoteUsage = `Usage: %s -remote <command> [<arg> ...]
+
+Commands:
+  list              list running instances and their open files
+  open FILE [LINE]  open a file in the most recently started instance, or
+                    in a new one if it can't, or raise the window that has
+                    it open
+  goto LINE         go to a line in the most recently started instance
+  save              save all modified files in all instances
+  raise FILE        raise the window that has a file open
+`
+
+// remoteMain controls running instances according to command-line arguments
+// and returns an exit status.
+func remoteMain(args []string) int {
+	if err := remoteCommand(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, remoteUsage, os.Args[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// remoteCommand carries out a -remote command.
+func remoteCommand(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "list" && len(args) == 0:
+		for _, c := range remoteInstances() {
+			paths, err := c.request("list", "")
+			c.close()
+			if err != nil {
+				return err
+			}
+			for _, path := range strings.SplitAfter(paths, "\n") {
+				if path != "" {
+					fmt.Printf("%s\t%s", c.instanceName(), path)
+				}
+			}
+		}
+	case cmd == "open" && (len(args) == 1 || len(args) == 2):
+		c := raiseRemote(args[0])
+		if c == nil {
+			clients := remoteInstances()
+			if len(clients) == 0 {
+				return errors.New("No running instances.")
+			}
+			for _, other := range clients[1:] {
+				other.close()
+			}
+			c = clients[0]
+			if _, err := c.request("open", absPath(args[0])); err != nil {
+				// it can't replace the file in its first pane
+				c.close()
+				if c, err = startInstance(args[0]); err != nil {
+					return err
+				}
+			}
+		}
+		defer c.close()
+		if len(args) == 2 {
+			_, err := c.request("goto", args[1])
+			return err
+		}
+	case cmd == "goto" && len(args) == 1:
+		clients := remoteInstances()
+		if len(clients) == 0 {
+			return errors.New("No running instances.")
+		}
+		for _, c := range clients {
+			defer c.close()
+		}
+		_, err := clients[0].request("goto", args[0])
+		return err
+	case cmd == "save" && len(args) == 0:
+		for _, c := range remoteInstances() {
+			paths, err := c.request("save", "")
+			c.close()
+			fmt.Print(paths)
+			if err != nil {
+				return err
+			}
+		}
+	case cmd == "raise" && len(args) == 1:
+		c := raiseRemote(args[0])
+		if c == nil {
+			return fmt.Errorf(`"%s" is not open.`, args[0])
+		}
+		c.close()
+	default:
+		return flag.ErrHelp
+	}
+	return nil
+}
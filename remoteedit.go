@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jangler/edit"
+)
+
+// Commands run from prompts can read and edit buffers through the socket named
+// by $FERVOR_SOCKET, using these remote commands:
+//
+//	pane ID       apply later requests on the connection to pane ID
+//	read          reply with the text of the buffer
+//	selection     reply with the selected text
+//	addr          reply with the address of the selection
+//	select ADDR   select the text at an address
+//	insert N      insert N bytes of text at the cursor
+//	replace N     replace the selection with N bytes of text, and select it
+//	status TEXT   show text in the status line
+//
+// The N bytes of text follow the request line. An address is a position or
+// two positions separated by a comma, where a position is a line number, a
+// line number and a column separated by a dot, or $ for the end of the buffer.
+// A line number alone denotes the whole line. Lines are numbered from 1 and
+// columns from 0, and columns count characters rather than bytes.
+//
+// Requests apply to the first pane unless the connection names another pane.
+// The ID of the pane a command was run from is in $FERVOR_PANE. While a
+// command pipes output into a pane, text can be changed anywhere but in the
+// output, so that the command itself can edit the rest of the buffer.
+
+// textCommands is the set of remote commands whose argument is followed by
+// that many bytes of text.
+var textCommands = map[string]bool{
+	"insert":  true,
+	"replace": true,
+}
+
+// parsePos returns the range of b denoted by a single position in an address.
+func parsePos(b *edit.Buffer, pos string) (start, end edit.Index, err error) {
+	pos = strings.TrimSpace(pos)
+	if pos == "$" {
+		return b.End(), b.End(), nil
+	}
+	fields := strings.SplitN(pos, ".", 2)
+	line, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return start, end, fmt.Errorf("Bad address: %s", pos)
+	}
+	if line < 1 || line > b.End().Line {
+		return start, end, fmt.Errorf("Line %d out of range.", line)
+	}
+	lineEnd := b.ShiftIndex(edit.Index{line + 1, 0}, -1)
+	if line == b.End().Line {
+		lineEnd = b.End()
+	}
+	if len(fields) == 1 {
+		return edit.Index{line, 0}, lineEnd, nil
+	}
+	col, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return start, end, fmt.Errorf("Bad address: %s", pos)
+	}
+	if col < 0 || col > lineEnd.Char {
+		return start, end, fmt.Errorf("Column %d out of range.", col)
+	}
+	return edit.Index{line, col}, edit.Index{line, col}, nil
+}
+
+// parseAddr returns the range of b denoted by an address.
+func parseAddr(b *edit.Buffer, addr string) (start, end edit.Index,
+	err error) {
+	positions := strings.SplitN(addr, ",", 2)
+	if start, end, err = parsePos(b, positions[0]); err != nil {
+		return
+	}
+	if len(positions) == 2 {
+		if _, end, err = parsePos(b, positions[1]); err != nil {
+			return
+		}
+	}
+	if end.Less(start) {
+		err = fmt.Errorf("Address out of order: %s", addr)
+	}
+	return
+}
+
+// formatAddr returns the address of the range from start to end.
+func formatAddr(start, end edit.Index) string {
+	return fmt.Sprintf("%d.%d,%d.%d", start.Line, start.Char, end.Line,
+		end.Char)
+}
+
+// targetPane returns the pane that the remote request being carried out
+// applies to: the pane named by the connection, or else the first pane.
+func (rc *RenderContext) targetPane() (*Pane, error) {
+	if rc.RemotePane == 0 {
+		return rc.Panes[0], nil
+	}
+	for _, p := range rc.Panes {
+		if p.ID == rc.RemotePane {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("Pane %d is closed.", rc.RemotePane)
+}
+
+// filePane returns the target pane, or an error if it is read-only.
+func (rc *RenderContext) filePane() (*Pane, error) {
+	p, err := rc.targetPane()
+	if err != nil {
+		return nil, err
+	}
+	if p.ReadOnly {
+		return nil, errors.New("Buffer is read-only.")
+	}
+	return p, nil
+}
+
+// checkPipe returns an error if replacing the text between start and end in p
+// would change the output of a command piping into p. Text inserted where the
+// output ends would join it.
+func checkPipe(p *Pane, start, end edit.Index) error {
+	if p.Pipe == nil {
+		return nil
+	}
+	outEnd := p.IndexFromMark(pipeMark)
+	outStart := p.ShiftIndex(outEnd, -p.Pipe.inserted)
+	if outStart.Less(end) && !outEnd.Less(start) {
+		return fmt.Errorf(`Command "%s" is piping output there.`,
+			p.Pipe.cmdString)
+	}
+	return nil
+}
+
+// editFile replaces the text between start and end in p with text, as a single
+// undoable action, and returns the end of the new text.
+func editFile(p *Pane, start, end edit.Index, text string) edit.Index {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if p.Regions != nil {
+		p.Regions.sync(p.Buffer)
+	}
+	p.Separate()
+	p.Group++
+	p.Delete(start, end)
+	p.Insert(start, text)
+	p.Group--
+	p.Separate()
+	end = p.ShiftIndex(start, len([]rune(text)))
+	if p.Regions != nil {
+		p.Regions.changed(start.Line, end.Line, p.End().Line)
+	}
+	return end
+}
+
+// remotePane makes later requests on the connection apply to the pane with
+// the ID given by arg.
+func remotePane(rc *RenderContext, arg string) (string, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < 1 {
+		return "", fmt.Errorf("Bad pane ID: %s", arg)
+	}
+	rc.RemotePane = id
+	_, err = rc.targetPane()
+	return "", err
+}
+
+// remoteRead replies with the text of the target pane.
+func remoteRead(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.targetPane()
+	if err != nil {
+		return "", err
+	}
+	return p.Get(edit.Index{1, 0}, p.End()), nil
+}
+
+// remoteSelection replies with the text selected in the target pane.
+func remoteSelection(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.targetPane()
+	if err != nil {
+		return "", err
+	}
+	return getSelection(p.Buffer), nil
+}
+
+// remoteAddr replies with the address of the selection in the target pane.
+func remoteAddr(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.targetPane()
+	if err != nil {
+		return "", err
+	}
+	return formatAddr(order(p.IndexFromMark(selMark),
+		p.IndexFromMark(insMark))), nil
+}
+
+// remoteSelect selects the text at the address given by arg in the target
+// pane.
+func remoteSelect(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.targetPane()
+	if err != nil {
+		return "", err
+	}
+	start, end, err := parseAddr(p.Buffer, arg)
+	if err != nil {
+		return "", err
+	}
+	p.Mark(start, selMark)
+	p.Mark(end, insMark)
+	seeMark(p.Buffer, insMark, p.Rows)
+	return "", nil
+}
+
+// remoteInsert inserts arg at the cursor in the target pane, leaving the
+// cursor after it.
+func remoteInsert(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.filePane()
+	if err != nil {
+		return "", err
+	}
+	ins := p.IndexFromMark(insMark)
+	if err := checkPipe(p, ins, ins); err != nil {
+		return "", err
+	}
+	end := editFile(p, ins, ins, arg)
+	p.Mark(end, selMark, insMark)
+	seeMark(p.Buffer, insMark, p.Rows)
+	return "", nil
+}
+
+// remoteReplace replaces the selection in the target pane with arg, and
+// selects the new text.
+func remoteReplace(rc *RenderContext, arg string) (string, error) {
+	p, err := rc.filePane()
+	if err != nil {
+		return "", err
+	}
+	start, end := order(p.IndexFromMark(selMark), p.IndexFromMark(insMark))
+	if err := checkPipe(p, start, end); err != nil {
+		return "", err
+	}
+	end = editFile(p, start, end, arg)
+	p.Mark(start, selMark)
+	p.Mark(end, insMark)
+	seeMark(p.Buffer, insMark, p.Rows)
+	return "", nil
+}
+
+// remoteStatus shows arg in the status line, unless a prompt is open.
+func remoteStatus(rc *RenderContext, arg string) (string, error) {
+	if rc.Focus != rc.Input {
+		rc.Status = arg
+	}
+	return "", nil
+}
@@ -0,0 +1,142 @@
+package main
+
+// editCommands is the set of commands that modify the buffer. A repeatable
+// edit consists of the text input and edit commands between other commands,
+// such as cursor motions.
+var editCommands = map[string]bool{
+	"cut":                  true,
+	"delete-backward":      true,
+	"delete-forward":       true,
+	"delete-line-backward": true,
+	"delete-word-backward": true,
+	"delete-word-forward":  true,
+	"enter":                true,
+	"indent":               true,
+	"insert-tab":           true,
+	"paste":                true,
+	"unindent":             true,
+}
+
+// writeCommands is the set of commands other than edit commands that modify
+// the buffer, and so are disabled in read-only panes.
+var writeCommands = map[string]bool{
+	"line-endings": true,
+	"open":         true,
+	"pipe":         true,
+	"redo":         true,
+	"repeat":       true,
+	"undo":         true,
+}
+
+// editStep is one part of a repeatable edit.
+type editStep struct {
+	cmd   string // command name, or empty for text input
+	shift bool   // shift argument to command
+	text  string // text input, or command line for "pipe"
+}
+
+// recordStep adds a step to the edit currently being recorded, beginning a
+// new edit if the last one was ended by a non-edit command.
+func (rc *RenderContext) recordStep(step editStep) {
+	if rc.Replaying {
+		return
+	}
+	if !rc.EditOpen {
+		rc.Edit, rc.EditOpen = nil, true
+	}
+	if n := len(rc.Edit); step.cmd == "" && n > 0 && rc.Edit[n-1].cmd == "" {
+		rc.Edit[n-1].text += step.text
+	} else {
+		rc.Edit = append(rc.Edit, step)
+	}
+	rc.LastEdit = rc.Edit
+}
+
+// runCommand runs the named command, recording it as part of a repeatable
+// edit if appropriate. Returns false if the application should quit.
+func (rc *RenderContext) runCommand(name string, shift bool) bool {
+	if rc.Focus == rc.Pane.Buffer {
+		special := kindCommands[rc.Pane.Kind][name]
+		if (editCommands[name] || writeCommands[name]) && !special &&
+			rc.readOnly() {
+			return true
+		}
+		if rc.Pane.Term != nil {
+			if writeCommands[name] {
+				rc.Status = "Not available in terminal buffers."
+				return true
+			}
+			if editCommands[name] {
+				if name = rc.Pane.termCommand(name); name == "" {
+					return true
+				}
+			}
+		}
+		if editCommands[name] && !special {
+			rc.recordStep(editStep{cmd: name, shift: shift})
+		} else {
+			rc.EditOpen = false
+		}
+	}
+	return commands[name].fn(rc, shift)
+}
+
+// typeText inserts text into the focus as if it were typed.
+func (rc *RenderContext) typeText(s string) {
+	if rc.readOnly() {
+		return
+	}
+	if rc.Focus == rc.Pane.Buffer {
+		if rc.Pane.Term != nil {
+			rc.Pane.termCommand("")
+		}
+		rc.recordStep(editStep{text: s})
+	}
+	textInput(rc.Focus, s)
+}
+
+// repeatEdit replays the last recorded edit at the current selection as a
+// single undoable action.
+func repeatEdit(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Pane.Buffer {
+		return true
+	}
+	if len(rc.LastEdit) == 0 {
+		rc.Status = "No edit to repeat."
+		return true
+	}
+	rc.Pane.Separate()
+	rc.Pane.Group++ // until replaySteps finishes
+	rc.replaySteps(rc.Pane, rc.LastEdit)
+	return true
+}
+
+// replaySteps replays the steps of a repeated edit in p. If a step pipes the
+// selection through a command, the steps after it are replayed when the
+// command exits, since the pane can't be edited until then.
+func (rc *RenderContext) replaySteps(p *Pane, steps []editStep) {
+	pane, focus := rc.Pane, rc.Focus // p may no longer be displayed
+	rc.Pane, rc.Focus, rc.Replaying = p, p.Buffer, true
+	defer func() {
+		rc.Pane, rc.Focus, rc.Replaying = pane, focus, false
+	}()
+	for i, step := range steps {
+		switch step.cmd {
+		case "":
+			textInput(p.Buffer, step.text)
+		case "pipe":
+			status := rc.pipeCmd(step.text)
+			if focus != rc.Input {
+				rc.Status = status
+			}
+			if p.Pipe != nil {
+				p.Pipe.repeat, p.Pipe.rest = true, steps[i+1:]
+				return
+			}
+		default:
+			commands[step.cmd].fn(rc, step.shift)
+		}
+	}
+	p.Group--
+	p.Separate()
+}
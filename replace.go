@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jangler/edit"
+)
+
+// replaceRun is a regexp replacement being entered or carried out.
+type replaceRun struct {
+	re       *regexp.Regexp
+	template string     // expanded with $1, ${name}, etc.
+	pane     *Pane      // pane being edited, once the run has started
+	next     edit.Index // where to search for the next match
+	atMatch  bool       // whether a match or replacement ends at next
+	count    int        // number of matches replaced
+}
+
+// replace prompts for a regexp to replace.
+func replace(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input && !rc.readOnly() {
+		rc.Prompt(replacePrompt)
+	}
+	return true
+}
+
+// replaceMessage returns a status message reporting n replacements.
+func replaceMessage(n int) string {
+	switch n {
+	case 0:
+		return "No matches."
+	case 1:
+		return "Replaced 1 match."
+	}
+	return fmt.Sprintf("Replaced %d matches.", n)
+}
+
+// replaceRange replaces all matches of re between start and end in p with the
+// expansion of template, and returns the number of matches replaced and the
+// index that end has become.
+func replaceRange(p *Pane, re *regexp.Regexp, template string, start,
+	end edit.Index) (int, edit.Index) {
+	text := p.Get(start, end)
+	locs := re.FindAllStringSubmatchIndex(text, -1)
+	delta := 0 // change in length of the range, in characters
+
+	// replace from the end, so that earlier indices remain valid
+	for i := len(locs) - 1; i >= 0; i-- {
+		loc := locs[i]
+		repl := string(re.ExpandString(nil, template, text, loc))
+		from := p.ShiftIndex(start, utf8.RuneCountInString(text[:loc[0]]))
+		to := p.ShiftIndex(from, utf8.RuneCountInString(text[loc[0]:loc[1]]))
+		p.Delete(from, to)
+		p.Insert(from, repl)
+		delta += utf8.RuneCountInString(repl) -
+			utf8.RuneCountInString(text[loc[0]:loc[1]])
+	}
+	return len(locs), p.ShiftIndex(start, utf8.RuneCountInString(text)+delta)
+}
+
+// startReplace carries out the replacement described by rc.Replace in the
+// current pane. mode begins with "a" to replace all matches in the buffer, "s"
+// to replace all matches in the selection, or "i" to ask about each match.
+func (rc *RenderContext) startReplace(mode string) {
+	r, p := rc.Replace, rc.Pane
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" || !strings.Contains("asi", mode[:1]) {
+		rc.Replace = nil
+		rc.Status = `Enter "a" (all), "s" (selection), or "i" (interactive).`
+		return
+	}
+	p.Separate()
+	switch mode[0] {
+	case 'a':
+		n, _ := replaceRange(p, r.re, r.template, edit.Index{1, 0}, p.End())
+		rc.finishReplace(n)
+	case 's':
+		sel, ins := order(p.IndexFromMark(selMark), p.IndexFromMark(insMark))
+		n, end := replaceRange(p, r.re, r.template, sel, ins)
+		p.Mark(sel, selMark)
+		p.Mark(end, insMark)
+		rc.finishReplace(n)
+	case 'i':
+		r.pane, r.next = p, edit.Index{1, 0}
+		p.Group++ // until finishReplace
+		rc.nextReplace()
+	}
+}
+
+// nextReplace selects the next match of an interactive replacement and asks
+// what to do with it, or finishes the run if there are no more matches.
+func (rc *RenderContext) nextReplace() {
+	r, p := rc.Replace, rc.Replace.pane
+
+	// search from the start of the line so that anchors are meaningful
+	start := edit.Index{r.next.Line, 0}
+	text := p.Get(start, p.End())
+	pos := len(p.Get(start, r.next))
+	for _, loc := range r.re.FindAllStringIndex(text, -1) {
+		// an empty match can't directly follow another match
+		if loc[0] > pos || loc[0] == pos && (loc[1] > pos || !r.atMatch) {
+			from := p.ShiftIndex(start, utf8.RuneCountInString(text[:loc[0]]))
+			p.Mark(from, selMark)
+			p.Mark(p.ShiftIndex(from,
+				utf8.RuneCountInString(text[loc[0]:loc[1]])), insMark)
+			seeMark(p.Buffer, insMark, p.Rows)
+			rc.Prompt(replaceAskPrompt)
+			return
+		}
+	}
+	rc.finishReplace(r.count)
+}
+
+// replaceAnswer acts on the selected match of an interactive replacement
+// according to answer: "y" to replace it, "n" to skip it, "a" to replace it
+// and all remaining matches, or "q" to stop. Any other answer is ignored.
+func (rc *RenderContext) replaceAnswer(answer string) {
+	r, p := rc.Replace, rc.Replace.pane
+	sel, ins := order(p.IndexFromMark(selMark), p.IndexFromMark(insMark))
+	switch strings.ToLower(answer) {
+	case "y", "":
+		n, end := replaceRange(p, r.re, r.template, sel, ins)
+		r.count += n
+		r.next, r.atMatch = end, true
+		p.Mark(end, selMark, insMark)
+		rc.nextReplace()
+	case "n":
+		r.next, r.atMatch = ins, true
+		if sel == ins {
+			if r.next = p.ShiftIndex(ins, 1); r.next == ins {
+				rc.finishReplace(r.count) // empty match at end of buffer
+				return
+			}
+			r.atMatch = false
+		}
+		rc.nextReplace()
+	case "a":
+		n, _ := replaceRange(p, r.re, r.template, sel, p.End())
+		p.Mark(sel, selMark, insMark)
+		rc.finishReplace(r.count + n)
+	case "q":
+		rc.finishReplace(r.count)
+	}
+}
+
+// finishReplace ends a replacement run, reporting the number of matches
+// replaced.
+func (rc *RenderContext) finishReplace(n int) {
+	p := rc.Pane
+	if rc.Replace.pane != nil { // interactive
+		p = rc.Replace.pane
+		p.Group--
+	}
+	p.Separate()
+	if p.Regions != nil {
+		p.Regions.reset(p.Buffer) // edits may be far from the cursor
+	}
+	rc.Replace = nil
+	rc.Status = replaceMessage(n)
+	rc.Focus = rc.Pane.Buffer
+}
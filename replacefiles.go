@@ -0,0 +1,544 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jangler/edit"
+)
+
+const (
+	previewTitle = "+Replace"
+	maxUndoLogs  = 20 // number of undo logs kept for each working directory
+)
+
+// hunk is a run of adjacent lines changed by a replacement in files. Lines
+// keep their carriage returns, and a replacement may contain newlines, so old
+// and new always have the same length.
+type hunk struct {
+	line     int // first line changed, starting at 1
+	old, new []string
+}
+
+// fileChange is the part of a replacement in files that applies to one file.
+type fileChange struct {
+	path     string // as shown in the preview
+	abs      string // absolute path
+	contents string // contents of the file when the preview was made
+	hunks    []*hunk
+}
+
+// previewRow is what a line of the preview pane shows: a hunk, or the header
+// of a file if hunk is nil.
+type previewRow struct {
+	change *fileChange
+	hunk   *hunk
+}
+
+// preview is a replacement in files that has not been written yet. It is
+// passed to the event loop once all files have been searched.
+type preview struct {
+	id      int // number of the preview, to discard the results of old ones
+	changes []*fileChange
+	rows    []previewRow // for each line of the preview pane
+	err     error
+}
+
+// undoEntry is the record of a change to a file in an undo log.
+type undoEntry struct {
+	Path          string
+	Before, After string
+}
+
+// replaceInFile returns the changes that replacing matches of re in each line
+// of the file at path with the expansion of template would make, or nil if no
+// lines would change.
+func replaceInFile(path string, re *regexp.Regexp,
+	template string) *fileChange {
+	contents, ok := readTextFile(path)
+	if !ok {
+		return nil
+	}
+	c := &fileChange{path: path, contents: contents}
+	var h *hunk
+	for i, line := range strings.Split(contents, "\n") {
+		text := strings.TrimSuffix(line, "\r")
+		repl := text
+		if re.MatchString(text) {
+			repl = re.ReplaceAllString(text, template)
+		}
+		if repl == text {
+			h = nil
+			continue
+		}
+		if h == nil {
+			h = &hunk{line: i + 1}
+			c.hunks = append(c.hunks, h)
+		}
+		h.old = append(h.old, line)
+		h.new = append(h.new, repl+line[len(text):])
+	}
+	if c.hunks == nil {
+		return nil
+	}
+	var err error
+	if c.abs, err = filepath.Abs(path); err != nil {
+		return nil
+	}
+	return c
+}
+
+// result returns the contents of the file after the change.
+func (c *fileChange) result() string {
+	lines := strings.Split(c.contents, "\n")
+	for _, h := range c.hunks {
+		copy(lines[h.line-1:], h.new)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// render returns the text of the preview pane in unified diff format, and sets
+// the rows of the preview.
+func (pv *preview) render() string {
+	var lines []string
+	pv.rows = nil
+	add := func(row previewRow, text ...string) {
+		for _, line := range text {
+			lines = append(lines, line)
+			pv.rows = append(pv.rows, row)
+		}
+	}
+	for _, c := range pv.changes {
+		add(previewRow{change: c}, "--- "+c.path, "+++ "+c.path)
+		offset := 0 // lines added before the hunk
+		for _, h := range c.hunks {
+			var old, new []string
+			for _, line := range h.old {
+				old = append(old, "-"+strings.TrimSuffix(line, "\r"))
+			}
+			for _, line := range strings.Split(strings.Join(h.new, "\n"),
+				"\n") {
+				new = append(new, "+"+strings.TrimSuffix(line, "\r"))
+			}
+			add(previewRow{c, h}, fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.line,
+				len(old), h.line+offset, len(new)))
+			add(previewRow{c, h}, append(old, new...)...)
+			offset += len(new) - len(old)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hunkCount returns the number of hunks in the preview.
+func (pv *preview) hunkCount() int {
+	n := 0
+	for _, c := range pv.changes {
+		n += len(c.hunks)
+	}
+	return n
+}
+
+// replaceFiles prompts for a regexp to replace in files.
+func replaceFiles(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(replaceFilesPrompt)
+	}
+	return true
+}
+
+// startPreview searches files under the working directory for matches of re
+// in the background and returns a status message. The replacements that would
+// be made are shown in the preview pane.
+func (rc *RenderContext) startPreview(re *regexp.Regexp,
+	template string) string {
+	rc.PreviewCount++
+	id := rc.PreviewCount
+	go func() {
+		pv := &preview{id: id}
+		var mu sync.Mutex
+		pv.err = walkFiles(func(path string) {
+			if c := replaceInFile(path, re, template); c != nil {
+				mu.Lock()
+				pv.changes = append(pv.changes, c)
+				mu.Unlock()
+			}
+		})
+		sort.Slice(pv.changes, func(i, j int) bool {
+			return pv.changes[i].path < pv.changes[j].path
+		})
+		postMessage(pv)
+	}()
+	return fmt.Sprintf(`Searching files for "%s"...`, re)
+}
+
+// previewDone shows the latest preview in the preview pane.
+func (rc *RenderContext) previewDone(pv *preview) {
+	if pv.id != rc.PreviewCount {
+		return
+	}
+	if pv.err != nil {
+		rc.Status = pv.err.Error()
+		return
+	}
+	if len(pv.changes) == 0 {
+		rc.Status = "No matches."
+		return
+	}
+	rc.Preview = pv
+	rc.showPreview(1)
+	rc.Status = fmt.Sprintf("%d hunks in %d files. Delete drops a hunk; "+
+		"save writes the files.", pv.hunkCount(), len(pv.changes))
+}
+
+// showPreview fills the preview pane with the current preview and displays it
+// with the cursor at line.
+func (rc *RenderContext) showPreview(line int) {
+	p := rc.findPane(previewTitle)
+	if p == nil {
+		p = newScratchPane(previewTitle, "")
+		p.Kind = previewPane
+	}
+	p.Delete(edit.Index{1, 0}, p.End())
+	p.Insert(edit.Index{1, 0}, rc.Preview.render())
+	p.ResetModified()
+	p.ResetUndo()
+	if end := p.End().Line; line > end {
+		line = end
+	}
+	p.Mark(edit.Index{line, 0}, selMark, insMark)
+	rc.showPane(p)
+	seeMark(p.Buffer, insMark, p.Rows)
+}
+
+// dropHunk removes the hunk shown on a line of the preview pane from the
+// preview, or all hunks of the file if the line is a file header.
+func (rc *RenderContext) dropHunk(line int) {
+	pv := rc.Preview
+	if pv == nil || line > len(pv.rows) {
+		return // already written
+	}
+	row := pv.rows[line-1]
+	var hunks []*hunk
+	for _, h := range row.change.hunks {
+		if row.hunk != nil && h != row.hunk {
+			hunks = append(hunks, h)
+		}
+	}
+	row.change.hunks = hunks
+	if hunks == nil {
+		var changes []*fileChange
+		for _, c := range pv.changes {
+			if c != row.change {
+				changes = append(changes, c)
+			}
+		}
+		pv.changes = changes
+	}
+	if len(pv.changes) == 0 {
+		rc.Preview = nil
+		rc.closePane()
+		rc.Status = "Dropped all hunks."
+		return
+	}
+	rc.showPreview(line)
+	rc.Status = fmt.Sprintf("%d hunks in %d files.", pv.hunkCount(),
+		len(pv.changes))
+}
+
+// unsavedPane returns an open pane with unsaved changes to the file at the
+// absolute path abs, or nil if there is none.
+func (rc *RenderContext) unsavedPane(abs string) *Pane {
+	for _, p := range rc.filePanes(abs) {
+		if p.Modified() {
+			return p
+		}
+	}
+	return nil
+}
+
+// filePanes returns the open panes of the file at the absolute path abs.
+func (rc *RenderContext) filePanes(abs string) []*Pane {
+	var panes []*Pane
+	for _, p := range rc.Panes {
+		if !p.Scratch && absPath(p.Title) == abs {
+			panes = append(panes, p)
+		}
+	}
+	return panes
+}
+
+// reloadPane replaces the text of p with the contents of its file, as a single
+// undoable action.
+func reloadPane(p *Pane, contents string) {
+	ins := p.IndexFromMark(insMark)
+	p.Separate()
+	p.Group++
+	p.Delete(edit.Index{1, 0}, p.End())
+	p.Insert(edit.Index{1, 0}, contents)
+	penult := p.ShiftIndex(p.End(), -1)
+	if p.Get(penult, p.End()) == "\n" {
+		p.Delete(penult, p.End())
+	}
+	p.LineEnding = lineEnding(p.Buffer)
+	p.Group--
+	p.Separate()
+	if end := p.End().Line; ins.Line > end {
+		ins.Line = end
+	}
+	p.Mark(edit.Index{ins.Line, 0}, selMark, insMark)
+	p.ResetModified()
+	if p.Regions != nil {
+		p.Regions.reset(p.Buffer)
+	}
+}
+
+// writeFileSafely replaces the contents of a local file, creating it if
+// necessary, by writing a temporary file in the same directory and renaming it
+// over the original, so that the file is never left partly written.
+func writeFileSafely(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// undoLogDir returns the directory in which undo logs of replacements in files
+// under the working directory are stored. Each working directory has its own,
+// named after a hash of its path.
+func undoLogDir() (string, error) {
+	if dataDir() == "" {
+		return "", errors.New("No data directory for undo logs.")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir(), "replace-undo",
+		fmt.Sprintf("%x", sha1.Sum([]byte(wd)))), nil
+}
+
+// undoLogs returns the paths of the undo logs in dir, oldest first.
+func undoLogs(dir string) []string {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(names)
+	return names
+}
+
+// readUndoLog returns the entries of the undo log at path.
+func readUndoLog(path string) ([]undoEntry, error) {
+	var entries []undoEntry
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	}
+	return entries, err
+}
+
+// writeUndoLog replaces the entries of the undo log at path, creating it if
+// necessary. Logs hold copies of files, so only the user can read them.
+func writeUndoLog(path string, entries []undoEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ioutil.WriteFile(path, data, 0600)
+	}
+	return writeFileSafely(path, data)
+}
+
+// remainingEntries returns the entries whose files are not among those of
+// written.
+func remainingEntries(entries, written []undoEntry) []undoEntry {
+	done := make(map[string]bool)
+	for _, e := range written {
+		done[e.Path] = true
+	}
+	var rest []undoEntry
+	for _, e := range entries {
+		if !done[e.Path] {
+			rest = append(rest, e)
+		}
+	}
+	return rest
+}
+
+// writeFiles writes the changes in entries to their files and reloads the
+// panes of the files. It refuses to write anything if any of the files are
+// open with unsaved changes, and skips files whose contents are not Before.
+// It returns the entries that were written.
+func (rc *RenderContext) writeFiles(entries []undoEntry) ([]undoEntry,
+	error) {
+	for _, e := range entries {
+		if p := rc.unsavedPane(e.Path); p != nil {
+			return nil, fmt.Errorf(`"%s" has unsaved changes.`, p.Title)
+		}
+	}
+	var written []undoEntry
+	for _, e := range entries {
+		if contents, err := ioutil.ReadFile(e.Path); err != nil ||
+			string(contents) != e.Before {
+			continue // changed since
+		}
+		if err := writeFileSafely(e.Path, []byte(e.After)); err != nil {
+			return written, err
+		}
+		written = append(written, e)
+		for _, p := range rc.filePanes(e.Path) {
+			reloadPane(p, e.After)
+		}
+	}
+	return written, nil
+}
+
+// writeMessage returns a status message reporting that n of m files were
+// written, beginning with verb.
+func writeMessage(verb string, n, m int) string {
+	msg := fmt.Sprintf("%s %d files.", verb, n)
+	if n < m {
+		msg += fmt.Sprintf(" Skipped %d changed since.", m-n)
+	}
+	return msg
+}
+
+// applyPreview writes the changes in the preview to files, logging them so
+// that they can be reverted, and closes the preview pane.
+func (rc *RenderContext) applyPreview() {
+	if rc.Preview == nil {
+		rc.Status = "No replacement to write."
+		return
+	}
+	var entries []undoEntry
+	for _, c := range rc.Preview.changes {
+		entries = append(entries,
+			undoEntry{Path: c.abs, Before: c.contents, After: c.result()})
+	}
+
+	// the log is written first, so that a partial run can be reverted
+	dir, err := undoLogDir()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = os.Chmod(dir, 0700) // in case an older version created it
+	}
+	logPath := filepath.Join(dir,
+		time.Now().Format("20060102-150405.000000000")+".json")
+	if err == nil {
+		err = writeUndoLog(logPath, entries)
+	}
+	if err != nil {
+		rc.Status = err.Error()
+		return
+	}
+
+	written, err := rc.writeFiles(entries)
+	if len(written) == 0 {
+		os.Remove(logPath)
+		if err != nil {
+			rc.Status = err.Error() // nothing written; keep the preview
+			return
+		}
+	} else if len(written) < len(entries) {
+		writeUndoLog(logPath, written) // skipped files can't be reverted
+	}
+	if logs := undoLogs(dir); len(logs) > maxUndoLogs {
+		for _, path := range logs[:len(logs)-maxUndoLogs] {
+			os.Remove(path)
+		}
+	}
+	if rc.Pane.Kind == previewPane {
+		rc.closePane()
+	}
+	rc.Preview = nil
+	if err != nil {
+		rc.Status = err.Error()
+	} else {
+		rc.Status = writeMessage("Replaced in", len(written), len(entries))
+	}
+}
+
+// revertReplace reverts the last replacement in files under the working
+// directory that has not been fully reverted, using its undo log. Entries
+// that can't be reverted yet are kept in the log.
+func revertReplace(rc *RenderContext, shift bool) bool {
+	if rc.Focus == rc.Input {
+		return true
+	}
+	dir, err := undoLogDir()
+	if err != nil {
+		rc.Status = err.Error()
+		return true
+	}
+	logs := undoLogs(dir)
+	if len(logs) == 0 {
+		rc.Status = "No replacement to revert."
+		return true
+	}
+	logPath := logs[len(logs)-1]
+	entries, err := readUndoLog(logPath)
+	if err != nil {
+		rc.Status = err.Error()
+		return true
+	}
+
+	reverse := make([]undoEntry, len(entries))
+	for i, e := range entries {
+		reverse[i] = undoEntry{Path: e.Path, Before: e.After, After: e.Before}
+	}
+	written, err := rc.writeFiles(reverse)
+	rest := remainingEntries(entries, written)
+	if len(rest) == 0 {
+		os.Remove(logPath)
+	} else if len(written) > 0 {
+		if logErr := writeUndoLog(logPath, rest); err == nil {
+			err = logErr
+		}
+	}
+	if err != nil {
+		if len(written) > 0 {
+			err = fmt.Errorf("%v Reverted %d files.", err, len(written))
+		}
+		rc.Status = err.Error()
+		return true
+	}
+	rc.Status = writeMessage("Reverted", len(written), len(entries))
+	if len(rest) > 0 {
+		rc.Status += " They are kept in the undo log."
+	}
+	return true
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/jangler/edit"
+)
+
+// search is the state of an incremental search in one of the Find prompts.
+type search struct {
+	sel, ins edit.Index     // selection when the prompt was opened
+	top      edit.Index     // first visible index when the prompt was opened
+	input    string         // input last searched for
+	options  string         // search options last searched with
+	re       *regexp.Regexp // compiled input, if valid
+}
+
+// compileSearch compiles a search pattern according to the search options.
+// If literal is true, the pattern is text to find rather than a regexp.
+func compileSearch(pattern string, literal bool) (*regexp.Regexp, error) {
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if wholewordFlag {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if ignorecaseFlag {
+		pattern = `(?i)` + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// searchOptions returns the names of the search options that are set.
+func searchOptions() string {
+	var names []string
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"wrapsearch", wrapsearchFlag},
+		{"ignorecase", ignorecaseFlag},
+		{"literal", literalFlag},
+		{"wholeword", wholewordFlag},
+		{"inselection", inselectionFlag},
+	} {
+		if opt.set {
+			names = append(names, opt.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// joinNote joins the search options and a message into a prompt note.
+func joinNote(options, msg string) string {
+	if options == "" || msg == "" {
+		return options + msg
+	}
+	return options + "; " + msg
+}
+
+// startSearch opens a Find prompt, remembering the selection and scroll
+// position so that they can be restored if the search is cancelled.
+func (rc *RenderContext) startSearch(prompt string) {
+	p := rc.Pane
+	if inselectionFlag {
+		markSearchRange(p.Buffer)
+	}
+	rc.Search = &search{sel: p.IndexFromMark(selMark),
+		ins: p.IndexFromMark(insMark), top: p.IndexFromCoords(0, 0)}
+	rc.Prompt(prompt)
+	rc.PromptNote = searchOptions()
+}
+
+// toggleSearchOption returns a command that toggles a boolean search option
+// for the rest of the session. In a Find prompt, the search is updated.
+func toggleSearchOption(name string) func(*RenderContext, bool) bool {
+	return func(rc *RenderContext, shift bool) bool {
+		f := flag.Lookup(name)
+		value := strconv.FormatBool(f.Value.String() != "true")
+		flag.Set(name, value)
+		rc.Options[name] = value
+		if name == "inselection" && value == "true" {
+			markSearchRange(rc.Pane.Buffer)
+		}
+		if rc.Focus != rc.Input {
+			rc.Status = fmt.Sprintf("Set %s=%s.", name, value)
+		}
+		return true
+	}
+}
+
+// searching returns true if an incremental search is in progress.
+func (rc *RenderContext) searching() bool {
+	return rc.Search != nil && rc.Focus == rc.Input &&
+		(rc.Status == findForwardPrompt || rc.Status == findBackwardPrompt)
+}
+
+// updateSearch selects the match of the prompt input nearest the original
+// selection, if the input has changed since the last search. Errors are shown
+// as a note in the status line, leaving the selection where it is.
+func (rc *RenderContext) updateSearch() {
+	input := rc.Input.Get(edit.Index{1, 0}, rc.Input.End())
+	options := searchOptions()
+	if !rc.searching() || rc.HistSearch != nil ||
+		input == rc.Search.input && options == rc.Search.options {
+		return
+	}
+	rc.Search.input, rc.Search.options = input, options
+	re, err := compileSearch(input, literalFlag)
+	if err != nil {
+		rc.PromptNote = joinNote(options, err.Error())
+		return
+	}
+	rc.Search.re, rc.PromptNote = re, options
+	p := rc.Pane
+	p.Mark(rc.Search.sel, selMark)
+	p.Mark(rc.Search.ins, insMark)
+	if input != "" {
+		rc.PromptNote = joinNote(options,
+			find(p.Buffer, re, rc.Status == findForwardPrompt, ""))
+	}
+	seeMark(p.Buffer, insMark, p.Rows)
+}
+
+// endSearch ends an incremental search, restoring the selection to what it
+// was when the search began, so that the final search starts from there. If
+// cancel is true, the scroll position is also restored.
+func (rc *RenderContext) endSearch(cancel bool) {
+	if rc.Search == nil {
+		return
+	}
+	p := rc.Pane
+	p.Mark(rc.Search.sel, selMark)
+	p.Mark(rc.Search.ins, insMark)
+	if cancel {
+		_, row := p.CoordsFromIndex(rc.Search.top)
+		p.Scroll(row)
+	}
+	rc.Search, rc.PromptNote = nil, ""
+}
+
+// lastSearch returns the regexp for the last pattern searched for, compiled
+// with the current search options, or nil if there is none.
+func (rc *RenderContext) lastSearch() *regexp.Regexp {
+	if rc.Pattern == "" {
+		return nil
+	}
+	if key := rc.Pattern + "\x00" + searchOptions(); key != rc.SearchKey {
+		rc.SearchRegexp, _ = compileSearch(rc.Pattern, literalFlag)
+		rc.SearchKey = key
+	}
+	return rc.SearchRegexp
+}
+
+// highlightRegexps returns the regexps whose visible matches are highlighted:
+// the pattern being searched for or last searched for, and the word under the
+// cursor if nothing is selected.
+func (rc *RenderContext) highlightRegexps() []*regexp.Regexp {
+	var res []*regexp.Regexp
+	if rc.searching() {
+		if rc.Search.re != nil && rc.Search.input != "" {
+			res = append(res, rc.Search.re)
+		}
+	} else if re := rc.lastSearch(); re != nil {
+		res = append(res, re)
+	}
+	p := rc.Pane
+	if ins := p.IndexFromMark(insMark); ins == p.IndexFromMark(selMark) &&
+		p.Term == nil {
+		if start, end := wordBounds(p.Buffer, ins); start != end {
+			pattern := `\b` + regexp.QuoteMeta(p.Get(start, end)) + `\b`
+			if rc.WordRegexp == nil || rc.WordRegexp.String() != pattern {
+				rc.WordRegexp = regexp.MustCompile(pattern)
+			}
+			res = append(res, rc.WordRegexp)
+		}
+	}
+	return res
+}
+
+// visibleMatches returns the start and end indices of the non-empty matches of
+// res in the lines displayed in p.
+func visibleMatches(p *Pane, res []*regexp.Regexp) [][2]edit.Index {
+	if len(res) == 0 {
+		return nil
+	}
+	start := edit.Index{p.IndexFromCoords(0, 0).Line, 0}
+	text := p.Get(start, edit.Index{p.IndexFromCoords(0, p.Rows).Line, 1 << 30})
+	var matches [][2]edit.Index
+	for _, re := range res {
+		index, pos := start, 0
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			n := utf8.RuneCountInString(text[pos:loc[0]])
+			index = p.ShiftIndex(index, n)
+			end := p.ShiftIndex(index,
+				utf8.RuneCountInString(text[loc[0]:loc[1]]))
+			matches = append(matches, [2]edit.Index{index, end})
+			pos = loc[0]
+		}
+	}
+	return matches
+}
+
+// matchCount is the position of a selected match among all matches in a
+// pane, counted in the background.
+type matchCount struct {
+	pane      *Pane
+	sel, ins  edit.Index // selection when counting began
+	i, n      int
+	wrapped   bool  // whether the search wrapped to find the match
+	cancelled int32 // set atomically when a newer count supersedes this one
+}
+
+// byteOffset returns the offset in text, which begins at index start of a
+// buffer, of the buffer index i.
+func byteOffset(text string, start, i edit.Index) int {
+	offset, chars := 0, i.Char-start.Char
+	for line := start.Line; line < i.Line; line++ {
+		offset += strings.IndexByte(text[offset:], '\n') + 1
+		chars = i.Char
+	}
+	for ; chars > 0 && offset < len(text); chars-- {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return offset
+}
+
+// matchAfter returns the location of the match of re that find would select
+// next from offset pos in text, and the offset to search from after it.
+func matchAfter(re *regexp.Regexp, text string, pos int) (loc []int,
+	next int) {
+	if loc = re.FindStringIndex(text[pos:]); loc == nil {
+		return nil, 0
+	}
+	loc[0], loc[1] = loc[0]+pos, loc[1]+pos
+	next = loc[1]
+	if loc[0] == loc[1] {
+		// skip the empty match, or stop at the end of the text
+		if _, size := utf8.DecodeRuneInString(text[next:]); size > 0 {
+			next += size
+		} else {
+			next++
+		}
+	}
+	return loc, next
+}
+
+// count counts the matches of re in text that repeated searches would
+// select, before and after the selected match between byte offsets sel and
+// ins. The count is passed to the event loop unless it is cancelled.
+func (c *matchCount) count(re *regexp.Regexp, text string, sel, ins int) {
+	c.i = 1
+	for pos := 0; pos <= len(text); {
+		if atomic.LoadInt32(&c.cancelled) != 0 {
+			return
+		}
+		loc, next := matchAfter(re, text, pos)
+		if loc == nil || loc[0] >= sel || loc[1] > sel {
+			break
+		}
+		c.i, pos = c.i+1, next
+	}
+	c.n = c.i
+	pos := ins
+	if sel == ins {
+		_, pos = matchAfter(re, text, ins) // skip the empty selected match
+	}
+	for pos <= len(text) {
+		if atomic.LoadInt32(&c.cancelled) != 0 {
+			return
+		}
+		loc, next := matchAfter(re, text, pos)
+		if loc == nil {
+			break
+		}
+		c.n, pos = c.n+1, next
+	}
+	postMessage(c)
+}
+
+// findMatch selects the next or previous match of the last search. The
+// position of the match is shown in the status line once the matches have been
+// counted.
+func (rc *RenderContext) findMatch(forward bool) {
+	p, re := rc.Pane, rc.lastSearch()
+	status := find(p.Buffer, re, forward, "")
+	p.Separate()
+	if rc.Count != nil {
+		atomic.StoreInt32(&rc.Count.cancelled, 1)
+		rc.Count = nil
+	}
+	if status != "" {
+		rc.Status = status
+		if status != wrappedStatus {
+			return
+		}
+	}
+
+	// counting could take a while in a large buffer
+	count := &matchCount{pane: p, sel: p.IndexFromMark(selMark),
+		ins: p.IndexFromMark(insMark), wrapped: status != ""}
+	rc.Count = count
+	sel, ins := order(count.sel, count.ins)
+	start, end := searchRange(p.Buffer)
+	text := p.Get(start, end)
+	go count.count(re, text, byteOffset(text, start, sel),
+		byteOffset(text, start, ins))
+}
+
+// matchCounted shows the position of a match in the status line, if the match
+// is still selected.
+func (rc *RenderContext) matchCounted(count *matchCount) {
+	if count != rc.Count {
+		return
+	}
+	rc.Count = nil
+	p := rc.Pane
+	if p == count.pane && rc.Focus == p.Buffer &&
+		p.IndexFromMark(selMark) == count.sel &&
+		p.IndexFromMark(insMark) == count.ins {
+		rc.Status = fmt.Sprintf("Match %d of %d.", count.i, count.n)
+		if count.wrapped {
+			rc.Status = wrappedStatus + " " + rc.Status
+		}
+	}
+}
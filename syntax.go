@@ -1,6 +1,10 @@
 package main
 
-import "github.com/jangler/edit"
+import (
+	"regexp"
+
+	"github.com/jangler/edit"
+)
 
 func mustCompile(pattern string, id int) edit.Rule {
 	rule, err := edit.NewRule(pattern, id)
@@ -27,9 +31,45 @@ var syntaxMap = map[string]func() []edit.Rule{
 	"[json]":       jsonRules,
 	"[lua]":        luaRules,
 	"[make]":       makefileRules,
+	"[markdown]":   markdownRules,
 	"[python]":     pythonRules,
+	"[rst]":        rstRules,
 	"[ruby]":       rubyRules,
 	"[svg]":        svgRules,
+	"[tcl]":        tclRules,
+}
+
+// regionMap maps INI sections to multi-line syntax rules, which are applied
+// on top of the rules in syntaxMap.
+var regionMap = map[string]func() *regionRules{
+	"[c]":          cRegions,
+	"[css]":        cssRegions,
+	"[go]":         goRegions,
+	"[html]":       htmlRegions,
+	"[javascript]": javaScriptRegions,
+	"[lua]":        luaRegions,
+	"[markdown]":   markdownRegions,
+	"[python]":     pythonRegions,
+	"[rst]":        rstRegions,
+	"[ruby]":       rubyRegions,
+	"[svg]":        htmlRegions,
+	"[tcl]":        tclRegions,
+}
+
+// quoteSkip matches single- and double-quoted strings, in which regions can't
+// begin.
+const quoteSkip = `'(\\.|[^'])*?'|"(\\.|[^"])*?"`
+
+// blockComment returns a region for C-style block comments.
+func blockComment() region {
+	return region{start: regexp.MustCompile(`/\*`),
+		end: regexp.MustCompile(`\*/`), id: commentID}
+}
+
+// htmlComment returns a region for HTML comments.
+func htmlComment() region {
+	return region{start: regexp.MustCompile(`<!--`),
+		end: regexp.MustCompile(`-->`), id: commentID}
 }
 
 // bashRules returns syntax highlighting rules for Bash.
@@ -200,6 +240,24 @@ func makefileRules() []edit.Rule {
 	}
 }
 
+// markdownRules returns syntax highlighting rules for Markdown.
+func markdownRules() []edit.Rule {
+	return []edit.Rule{
+		mustCompile(`<!--.*?-->`, commentID),
+		mustCompile(`^#{1,6}(\s.*)?$`, keywordID),
+		mustCompile(`^(=+|-+)\s*$`, keywordID),
+		mustCompile(`^\s*([-*+]|\d+[.)])\s`, keywordID),
+		mustCompile(`^\s*>`, keywordID),
+		mustCompile("^\\s*(```|~~~).*$", literalID),
+		mustCompile("``.+?``|`[^`]+`", literalID),
+		mustCompile(`\*\*[^*]+\*\*|__[^_]+__`, literalID),
+		mustCompile(`\*[^*\s][^*]*\*|\b_[^_\s][^_]*_\b`, literalID),
+		mustCompile(`!?\[[^\]]*\](\([^)]*\)|\[[^\]]*\])`, commentID),
+		mustCompile(`^\s*\[[^\]]+\]:.*$`, commentID),
+		mustCompile(`<(https?|ftp|mailto):[^>]*>`, commentID),
+	}
+}
+
 // pythonRules returns syntax highlighting rules for Python.
 func pythonRules() []edit.Rule {
 	return []edit.Rule{
@@ -226,6 +284,24 @@ func pythonRules() []edit.Rule {
 	}
 }
 
+// rstRules returns syntax highlighting rules for reStructuredText.
+func rstRules() []edit.Rule {
+	return []edit.Rule{
+		mustCompile(`^\s*\.\. ([\w-]+(:[\w-]+)*::|_[^:]+:|\[[^\]]+\]|`+
+			`\|[^|]+\|)`, keywordID),
+		mustCompile(`^\s*\.\.(\s.*)?$`, commentID),
+		mustCompile("^(=+|-+|~+|\\^+|\\*+|#+|\\++|`+|:+|'+|\"+|_+|\\.+)\\s*$",
+			keywordID),
+		mustCompile(`^\s*:[^:\s][^:]*:(\s|$)`, keywordID),
+		mustCompile(`^\s*([-*+•]|\d+\.|#\.|\(?[a-zA-Z0-9]\))\s`, keywordID),
+		mustCompile("``.+?``", literalID),
+		mustCompile("(:[\\w.+-]+:)?`[^`]+`(:[\\w.+-]+:|__?)?", literalID),
+		mustCompile(`\*\*[^*]+\*\*|\*[^*\s][^*]*\*`, literalID),
+		mustCompile(`\[[\w#*-]+\]_`, literalID),
+		mustCompile(`::\s*$`, literalID),
+	}
+}
+
 // rubyRules returns syntax highlighting rules for Ruby.
 func rubyRules() []edit.Rule {
 	return []edit.Rule{
@@ -277,3 +353,150 @@ func svgRules() []edit.Rule {
 		mustCompile(`'(\\.|[^'])*?'|"(\\.|[^"])*?"`, literalID),
 	}
 }
+
+// tclRules returns syntax highlighting rules for Tcl.
+func tclRules() []edit.Rule {
+	return []edit.Rule{
+		mustCompile(`(^\s*|;\s*)#.*$`, commentID),
+		mustCompile(`\b(after|append|apply|array|break|catch|cd|chan|clock|`+
+			`close|concat|continue|dict|else|elseif|encoding|eof|error|eval|`+
+			`exec|exit|expr|fconfigure|file|fileevent|flush|for|foreach|`+
+			`format|gets|glob|global|if|incr|info|interp|join|lappend|lassign|`+
+			`lindex|linsert|list|llength|lmap|load|lrange|lrepeat|lreplace|`+
+			`lreverse|lsearch|lset|lsort|namespace|open|package|pid|proc|puts|`+
+			`pwd|read|regexp|regsub|rename|return|scan|seek|set|socket|source|`+
+			`split|string|subst|switch|tailcall|tell|then|throw|time|trace|`+
+			`try|unset|update|uplevel|upvar|variable|vwait|while|yield)\b`,
+			keywordID),
+		mustCompile(`[{}\[\]]`, keywordID),
+		mustCompile(`\$(\{[^}]*\}|(::)?\w+(::\w+)*(\([^)]*\))?)`, literalID),
+		mustCompile(`"(\\.|[^"])*?"`, literalID),
+		mustCompile(`\b0[xX][0-9a-fA-F]+\b`, literalID),
+		mustCompile(`\b(\d+\.\d*|\d*\.\d+|\d+)([eE][+-]?\d+)?\b`,
+			literalID),
+	}
+}
+
+// cRegions returns multi-line syntax rules for C.
+func cRegions() *regionRules {
+	return &regionRules{
+		regions: []region{blockComment()},
+		skip:    regexp.MustCompile(`//.*$|L?` + quoteSkip),
+	}
+}
+
+// cssRegions returns multi-line syntax rules for CSS.
+func cssRegions() *regionRules {
+	return &regionRules{
+		regions: []region{blockComment()},
+		skip:    regexp.MustCompile(quoteSkip),
+	}
+}
+
+// goRegions returns multi-line syntax rules for Go.
+func goRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			blockComment(),
+			{start: regexp.MustCompile("`"), end: regexp.MustCompile("`"),
+				id: literalID},
+		},
+		skip: regexp.MustCompile(`//.*$|` + quoteSkip),
+	}
+}
+
+// htmlRegions returns multi-line syntax rules for HTML and SVG.
+func htmlRegions() *regionRules {
+	return &regionRules{regions: []region{htmlComment()}}
+}
+
+// javaScriptRegions returns multi-line syntax rules for JavaScript.
+func javaScriptRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			blockComment(),
+			{start: regexp.MustCompile("`"), end: regexp.MustCompile("`"),
+				skip: regexp.MustCompile(`\\.`), id: literalID},
+		},
+		skip: regexp.MustCompile(`//.*$|` + quoteSkip),
+	}
+}
+
+// luaRegions returns multi-line syntax rules for Lua.
+func luaRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			{start: regexp.MustCompile(`--\[\[`),
+				end: regexp.MustCompile(`\]\]`), id: commentID},
+			{start: regexp.MustCompile(`\[\[`),
+				end: regexp.MustCompile(`\]\]`), id: literalID},
+		},
+		skip: regexp.MustCompile(`--.*$|` + quoteSkip),
+	}
+}
+
+// markdownRegions returns multi-line syntax rules for Markdown.
+func markdownRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			htmlComment(),
+			{start: regexp.MustCompile("^\\s*(```|~~~)"),
+				end: regexp.MustCompile("^\\s*(```|~~~)\\s*$"), id: literalID},
+		},
+		skip: regexp.MustCompile("``.+?``|`[^`]+`"),
+	}
+}
+
+// pythonRegions returns multi-line syntax rules for Python.
+func pythonRegions() *regionRules {
+	escape := regexp.MustCompile(`\\.`)
+	return &regionRules{
+		regions: []region{
+			{start: regexp.MustCompile(`'''`),
+				end: regexp.MustCompile(`'''`), skip: escape, id: literalID},
+			{start: regexp.MustCompile(`"""`), end: regexp.MustCompile(`"""`),
+				skip: escape, id: literalID},
+		},
+		skip: regexp.MustCompile(`#.*$|` + quoteSkip),
+	}
+}
+
+// rstRegions returns multi-line syntax rules for reStructuredText.
+func rstRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			// a literal block runs until the next unindented line
+			{start: regexp.MustCompile(`::\s*$`),
+				end: regexp.MustCompile(`^(?P<region>)\S`), id: literalID},
+		},
+		skip: regexp.MustCompile(`^\s*\.\..*$`), // directives end in :: too
+	}
+}
+
+// rubyRegions returns multi-line syntax rules for Ruby.
+func rubyRegions() *regionRules {
+	return &regionRules{
+		regions: []region{{start: regexp.MustCompile(`^=begin\b`),
+			end: regexp.MustCompile(`^=end\b`), id: commentID}},
+		skip: regexp.MustCompile(`#.*$|` + quoteSkip),
+	}
+}
+
+// tclRegions returns multi-line syntax rules for Tcl.
+func tclRegions() *regionRules {
+	return &regionRules{
+		regions: []region{
+			// a backslash at the end of a comment continues it
+			{start: regexp.MustCompile(
+				`(^|;)\s*(?P<region>#(.*[^\\])?(\\\\)*\\)$`),
+				end: regexp.MustCompile(`^(.*[^\\])?(\\\\)*$`),
+				id:  commentID},
+			{start: regexp.MustCompile(
+				`\b(set|variable)\s+\S+\s+(?P<region>\{)`),
+				end:  regexp.MustCompile(`\}`),
+				skip: regexp.MustCompile(`\\.|\{[^{}]*\}`), id: literalID},
+			// missing: braces nested across lines in a braced value
+		},
+		skip: regexp.MustCompile(`(^|;)\s*#.*$|"(\\.|[^"])*?"`),
+	}
+}
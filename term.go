@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jangler/edit"
+)
+
+// terminal is a process running in a pseudo-terminal, whose output is shown
+// in a pane. Text typed after the output is sent to the process a line at a
+// time.
+type terminal struct {
+	cmdString  string
+	cmd        *exec.Cmd
+	pty        *os.File
+	cursor     edit.Index // position where output is written
+	inputStart edit.Index // beginning of input not yet sent to the process
+	partial    string     // incomplete escape sequence at end of last output
+	done       bool       // whether the process has exited
+}
+
+// termOutput is output from a terminal process, passed to the event loop.
+type termOutput struct {
+	term *terminal
+	text string
+	done bool // whether the process has exited
+}
+
+// newTerminal starts cmdString in a pseudo-terminal, or an interactive shell
+// if cmdString is empty, as if run from the pane with ID paneID. Output is
+// returned on the SDL event queue.
+func newTerminal(cmdString string, paneID int) (*terminal, error) {
+	var cmd *exec.Cmd
+	if cmdString == "" {
+		if cmdString = os.Getenv("SHELL"); cmdString == "" {
+			cmdString = shellName
+		}
+		cmd = exec.Command(cmdString)
+	} else {
+		cmd = exec.Command(shellName, shellOpt, cmdString)
+	}
+	cmd.Env = append(commandEnv(paneID), "TERM=dumb")
+	f, err := startPty(cmd)
+	if err != nil {
+		return nil, err
+	}
+	t := &terminal{cmdString: cmdString, cmd: cmd, pty: f,
+		cursor: edit.Index{1, 0}, inputStart: edit.Index{1, 0}}
+	go t.read()
+	return t, nil
+}
+
+// read passes output from the process to the event loop until the process
+// exits.
+func (t *terminal) read() {
+	buf := make([]byte, 4096)
+	var rest []byte // incomplete UTF-8 sequence at end of last read
+	for {
+		n, err := t.pty.Read(buf)
+		if n > 0 {
+			data := append(rest, buf[:n]...)
+			valid := utf8Prefix(data)
+			postMessage(&termOutput{term: t,
+				text: string(data[:valid])})
+			rest = append([]byte(nil), data[valid:]...)
+		}
+		if err != nil {
+			break
+		}
+	}
+	reportExitStatus(t.cmdString, t.cmd.Wait())
+	postMessage(&termOutput{term: t, done: true})
+}
+
+// close stops the process, if it is still running.
+func (t *terminal) close() {
+	t.pty.Close()
+	if !t.done && t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+}
+
+// openTerminal prompts for a command to run in a terminal buffer.
+func openTerminal(rc *RenderContext, shift bool) bool {
+	if rc.Focus != rc.Input {
+		rc.Prompt(terminalPrompt)
+	}
+	return true
+}
+
+// startTerminal starts cmdString in a new terminal pane and displays it.
+func (rc *RenderContext) startTerminal(cmdString string) {
+	t, err := newTerminal(cmdString, rc.paneID(rc.Pane))
+	if err != nil {
+		rc.Status = err.Error()
+		return
+	}
+	p := newScratchPane(fmt.Sprintf("+Terminal: %s", t.cmdString), "")
+	p.ReadOnly, p.Term = false, t
+	rc.showPane(p)
+}
+
+// termEvent processes output from a terminal process.
+func (rc *RenderContext) termEvent(out *termOutput) {
+	for _, p := range rc.Panes {
+		if p.Term != out.term {
+			continue
+		}
+		if out.done {
+			p.Term.done = true
+		} else {
+			p.termWrite(out.text)
+			ins := p.IndexFromMark(insMark)
+			if p == rc.Pane && !ins.Less(p.Term.inputStart) {
+				seeMark(p.Buffer, insMark, p.Rows)
+			}
+		}
+	}
+}
+
+// termSend sends the input at the end of a terminal pane to the process. The
+// input is removed from the buffer, since the terminal echoes it.
+func (p *Pane) termSend() error {
+	t := p.Term
+	if t.done {
+		return errors.New("Process has exited.")
+	}
+	input := p.Get(t.inputStart, p.End())
+	p.Delete(t.inputStart, p.End())
+	_, err := io.WriteString(t.pty, input+"\n")
+	return err
+}
+
+// termCommand prepares a terminal pane for an edit command, moving the cursor
+// to the end of the buffer if the selection is not within the input. It
+// returns the name of the command to run instead, or an empty string if the
+// command would delete output.
+func (p *Pane) termCommand(name string) string {
+	t := p.Term
+	sel, ins := order(p.IndexFromMark(selMark), p.IndexFromMark(insMark))
+	if sel.Less(t.inputStart) {
+		p.Mark(p.End(), selMark, insMark)
+		sel, ins = p.End(), p.End()
+	}
+	if sel != ins {
+		return name
+	}
+	var start edit.Index
+	switch name {
+	case "delete-backward":
+		start = p.ShiftIndex(ins, -1)
+	case "delete-line-backward":
+		start = edit.Index{ins.Line, 0}
+	case "delete-word-backward":
+		start = shiftIndexByWord(p.Buffer, ins, -1)
+	default:
+		return name
+	}
+	if ins == t.inputStart {
+		return ""
+	}
+	if start.Less(t.inputStart) {
+		p.Mark(t.inputStart, selMark)
+		return "delete-backward"
+	}
+	return name
+}
+
+// runeCount returns the number of characters between two indices in b.
+func runeCount(b *edit.Buffer, start, end edit.Index) int {
+	return utf8.RuneCountInString(b.Get(start, end))
+}
+
+// termWrite writes process output to a terminal pane, handling carriage
+// returns, backspaces, and basic ANSI erase sequences. Other control
+// characters and escape sequences are discarded.
+func (p *Pane) termWrite(s string) {
+	t := p.Term
+	s, t.partial = t.partial+s, ""
+
+	// set aside input that hasn't been sent yet
+	selOffset, insOffset := -1, -1
+	if sel := p.IndexFromMark(selMark); !sel.Less(t.inputStart) {
+		selOffset = runeCount(p.Buffer, t.inputStart, sel)
+	}
+	if ins := p.IndexFromMark(insMark); !ins.Less(t.inputStart) {
+		insOffset = runeCount(p.Buffer, t.inputStart, ins)
+	}
+	input := p.Get(t.inputStart, p.End())
+	p.Delete(t.inputStart, p.End())
+
+	cur := t.cursor
+	for len(s) > 0 {
+		switch c := s[0]; {
+		case c == '\x1b':
+			n := escapeLen(s)
+			if n == 0 {
+				t.partial, s = s, ""
+				break
+			}
+			cur = p.termEscape(cur, s[:n])
+			s = s[n:]
+		case c == '\r':
+			cur.Char = 0
+			s = s[1:]
+		case c == '\n':
+			if cur.Line == p.End().Line {
+				p.Insert(p.End(), "\n")
+			}
+			cur = edit.Index{cur.Line + 1, 0}
+			s = s[1:]
+		case c == '\b':
+			if cur.Char > 0 {
+				cur.Char--
+			}
+			s = s[1:]
+		case c == '\t' || c >= ' ' && c != '\x7f':
+			n := strings.IndexFunc(s, func(r rune) bool {
+				return r != '\t' && (r < ' ' || r == '\x7f')
+			})
+			if n < 0 {
+				n = len(s)
+			}
+			cur = p.termPut(cur, s[:n])
+			s = s[n:]
+		default: // bell, etc.
+			s = s[1:]
+		}
+	}
+	t.cursor = cur
+
+	// restore input
+	t.inputStart = p.End()
+	p.Insert(t.inputStart, input)
+	if selOffset >= 0 {
+		p.Mark(p.ShiftIndex(t.inputStart, selOffset), selMark)
+	}
+	if insOffset >= 0 {
+		p.Mark(p.ShiftIndex(t.inputStart, insOffset), insMark)
+	}
+	p.ResetUndo()
+}
+
+// termPut writes text at cur, overwriting any text after cur on the same line,
+// and returns the index following the written text.
+func (p *Pane) termPut(cur edit.Index, text string) edit.Index {
+	n := utf8.RuneCountInString(text)
+	over := runeCount(p.Buffer, cur, edit.Index{cur.Line, 1 << 30})
+	if over > n {
+		over = n
+	}
+	p.Delete(cur, edit.Index{cur.Line, cur.Char + over})
+	p.Insert(cur, text)
+	return edit.Index{cur.Line, cur.Char + n}
+}
+
+// escapeLen returns the length of the escape sequence at the beginning of s,
+// or 0 if the sequence is incomplete.
+func escapeLen(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
+	switch s[1] {
+	case '[': // control sequence, ended by a byte in the range @ to ~
+		for i := 2; i < len(s); i++ {
+			if s[i] >= '@' && s[i] <= '~' {
+				return i + 1
+			}
+		}
+	case ']': // operating system command, ended by BEL or ST
+		if i := strings.IndexByte(s, '\a'); i >= 0 {
+			return i + 1
+		}
+		if i := strings.Index(s, "\x1b\\"); i >= 0 {
+			return i + 2
+		}
+	default:
+		return 2
+	}
+	if len(s) > 256 {
+		return 2 // probably garbage; skip the introducer
+	}
+	return 0
+}
+
+// termEscape processes an escape sequence at cur and returns the new cursor
+// position. Only erase sequences and cursor-left are supported.
+func (p *Pane) termEscape(cur edit.Index, seq string) edit.Index {
+	if seq[1] != '[' {
+		return cur
+	}
+	param := seq[2 : len(seq)-1]
+	lineEnd := edit.Index{cur.Line, 1 << 30}
+	switch seq[len(seq)-1] {
+	case 'D': // cursor left
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			n = 1
+		}
+		if cur.Char -= n; cur.Char < 0 {
+			cur.Char = 0
+		}
+	case 'J': // erase in display
+		switch param {
+		case "", "0":
+			p.Delete(cur, p.End())
+		case "2", "3":
+			p.Delete(edit.Index{1, 0}, p.End())
+			cur = edit.Index{1, 0}
+		}
+	case 'K': // erase in line
+		switch param {
+		case "", "0":
+			p.Delete(cur, lineEnd)
+		case "1":
+			p.termPut(edit.Index{cur.Line, 0}, strings.Repeat(" ", cur.Char))
+		case "2":
+			p.Delete(edit.Index{cur.Line, 0}, lineEnd)
+			p.Insert(edit.Index{cur.Line, 0}, strings.Repeat(" ", cur.Char))
+		}
+	}
+	return cur
+}
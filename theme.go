@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// theme maps color names to colors. Every theme has the same set of names.
+type theme map[string]sdl.Color
+
+// maxThemeDepth limits how many themes can be based on each other.
+const maxThemeDepth = 8
+
+// builtinThemes are the themes that are always available. The dark theme is
+// used by default if the -dark flag is set.
+var builtinThemes = map[string]theme{
+	"light": {
+		"background": sdl.Color{0xff, 0xff, 0xff, 0xff},
+		"foreground": sdl.Color{0x2f, 0x2f, 0x2f, 0xff},
+		"status":     sdl.Color{0xe8, 0xe8, 0xe8, 0xff},
+		"selection":  sdl.Color{0xe8, 0xe8, 0xe8, 0xff},
+		"match":      sdl.Color{0xfb, 0xef, 0xc4, 0xff},
+		"cursor":     sdl.Color{0x2f, 0x2f, 0x2f, 0xff},
+		"comment":    sdl.Color{0x3f, 0x5a, 0x8d, 0xff},
+		"keyword":    sdl.Color{0x3a, 0x63, 0x41, 0xff},
+		"literal":    sdl.Color{0x8e, 0x4a, 0x43, 0xff},
+	},
+	"dark": {
+		"background": sdl.Color{0x25, 0x25, 0x25, 0xff},
+		"foreground": sdl.Color{0xe2, 0xe2, 0xe2, 0xff},
+		"status":     sdl.Color{0x40, 0x40, 0x40, 0xff},
+		"selection":  sdl.Color{0x40, 0x40, 0x40, 0xff},
+		"match":      sdl.Color{0x4a, 0x45, 0x2e, 0xff},
+		"cursor":     sdl.Color{0xe2, 0xe2, 0xe2, 0xff},
+		"comment":    sdl.Color{0xa0, 0xb6, 0xdf, 0xff},
+		"keyword":    sdl.Color{0x99, 0xbe, 0x9f, 0xff},
+		"literal":    sdl.Color{0xda, 0xaa, 0xa5, 0xff},
+	},
+}
+
+var (
+	bgColor, fgColor, statusColor, selectionColor, cursorColor sdl.Color
+	matchColor, commentColor, keywordColor, literalColor       sdl.Color
+
+	currentTheme string // name of the theme in use
+)
+
+// themeDir returns the directory that theme files are read from.
+func themeDir() string {
+	return filepath.Join(configDir(), "themes")
+}
+
+// themeName returns the name of the theme selected by flags.
+func themeName() string {
+	if themeFlag != "" {
+		return themeFlag
+	}
+	if darkFlag {
+		return "dark"
+	}
+	return "light"
+}
+
+// themeNames returns the names of built-in themes and theme files.
+func themeNames() []string {
+	var names []string
+	for name := range builtinThemes {
+		names = append(names, name)
+	}
+	if f, err := os.Open(themeDir()); err == nil {
+		if files, err := f.Readdirnames(0); err == nil {
+			names = append(names, files...)
+		}
+		f.Close()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseColor parses a color in the form #rrggbb.
+func parseColor(s string) (sdl.Color, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return sdl.Color{}, fmt.Errorf("Invalid color: %s", s)
+	}
+	return sdl.Color{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}, nil
+}
+
+// set changes colors in t using a map of color names to values. Bad entries
+// are skipped, and the returned error lists all of them.
+func (t theme) set(m map[string]string) error {
+	var errs []string
+	for k, v := range m {
+		if _, ok := t[k]; !ok {
+			errs = append(errs, "Unknown color: "+k)
+			continue
+		}
+		c, err := parseColor(v)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		t[k] = c
+	}
+	if errs != nil {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// joinErrors returns an error listing the messages of the non-nil errors in
+// errs, or nil if there are none.
+func joinErrors(errs ...error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if msgs == nil {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// loadTheme returns the named theme, which is either built in or read from a
+// file. A name containing a slash is the path of a theme file; otherwise the
+// file is in the themes directory. A theme file consists of name=#rrggbb lines,
+// and is based on the light theme unless it contains a base=name line. If some
+// lines are bad, the theme is returned along with an error.
+func loadTheme(name string, depth int) (theme, error) {
+	t := make(theme)
+	if builtin, ok := builtinThemes[name]; ok {
+		for k, v := range builtin {
+			t[k] = v
+		}
+		return t, nil
+	}
+	if depth >= maxThemeDepth {
+		return nil, fmt.Errorf("Themes nested too deeply: %s", name)
+	}
+
+	path := expandVars(name)
+	if !strings.ContainsAny(name, `/\`) {
+		path = filepath.Join(themeDir(), name)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, ";") {
+			continue
+		}
+		if tokens := strings.SplitN(line, "=", 2); len(tokens) == 2 {
+			m[strings.TrimSpace(tokens[0])] = strings.TrimSpace(tokens[1])
+		}
+	}
+	base := "light"
+	if b, ok := m["base"]; ok {
+		base = b
+		delete(m, "base")
+	}
+	if t, err = loadTheme(base, depth+1); t == nil {
+		return nil, err
+	}
+	return t, joinErrors(err, t.set(m))
+}
+
+// setColorScheme sets display colors using the theme selected by flags, with
+// any colors in the [colors] section of the .ini file applied on top. If the
+// theme can't be loaded, the light or dark theme is used instead and an error
+// is returned. Bad colors are skipped and listed in the error.
+func setColorScheme() error {
+	name := themeName()
+	t, err := loadTheme(name, 0)
+	if t == nil {
+		fallback := "light"
+		if darkFlag {
+			fallback = "dark"
+		}
+		t, _ = loadTheme(fallback, 0)
+	}
+	err = joinErrors(err, t.set(sectionFlags["[colors]"]))
+	currentTheme = name
+
+	bgColor = t["background"]
+	fgColor = t["foreground"]
+	statusColor = t["status"]
+	selectionColor = t["selection"]
+	matchColor = t["match"]
+	cursorColor = t["cursor"]
+	commentColor = t["comment"]
+	keywordColor = t["keyword"]
+	literalColor = t["literal"]
+	return err
+}